@@ -2,16 +2,57 @@ package agent
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
+
+	"github.com/yms2772/download_accelerator/discovery"
+	"github.com/yms2772/download_accelerator/frame"
+	"github.com/yms2772/download_accelerator/identity"
+	"github.com/yms2772/download_accelerator/relay"
+	"github.com/yms2772/download_accelerator/transport"
 )
 
+// handshakeTimeout is how long a downloader that dialed a listening agent has
+// to complete the hello before the agent waits for another one.
+const handshakeTimeout = 10 * time.Second
+
+// Build identifies the agent in its hello. Release builds set it with
+// -ldflags "-X github.com/yms2772/download_accelerator/agent.Build=<version>".
+var Build = "dev"
+
 type RunAgentOptions struct {
 	ID   string
 	IP   string
 	Port string
+	// MaxConnections bounds the connections the agent opens per file, and
+	// MemoryBudget the bytes it buffers at once. Zero means no limit.
+	MaxConnections int
+	MemoryBudget   int64
+	// Listen is the address the agent listens on for the downloader to dial
+	// it, instead of dialing IP and Port.
+	Listen string
+	// Relay is the address of a relay the agent joins Room on, instead of
+	// dialing IP and Port.
+	Relay string
+	Room  string
+	// WebSocket is the ws:// or wss:// URL of the downloader, reached through
+	// HTTPS_PROXY when it is set, instead of dialing IP and Port.
+	WebSocket string
+	// Fingerprint enables TLS and pins the certificate of the downloader.
+	Fingerprint string
+	// Key identifies the agent, loaded from the key file when nil.
+	// PairingCode is the code shown by a downloader the agent is not paired
+	// with yet.
+	Key         ed25519.PrivateKey
+	PairingCode string
 }
 
 type Data struct {
@@ -25,30 +66,159 @@ func New() *Data {
 	return data
 }
 
+// keyFile returns the path of the agent key, DOWNLOAD_ACCELERATOR_KEY or a
+// file in the user config directory.
+func keyFile() string {
+	if path := os.Getenv("DOWNLOAD_ACCELERATOR_KEY"); len(path) != 0 {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "download_accelerator", identity.KeyFile)
+}
+
+// OptionsFromEnv reads the options of an agent from the
+// DOWNLOAD_ACCELERATOR_* environment variables.
+func OptionsFromEnv() RunAgentOptions {
+	opts := RunAgentOptions{
+		ID:          os.Getenv("DOWNLOAD_ACCELERATOR_ID"),
+		IP:          os.Getenv("DOWNLOAD_ACCELERATOR_IP"),
+		Port:        os.Getenv("DOWNLOAD_ACCELERATOR_PORT"),
+		Listen:      os.Getenv("DOWNLOAD_ACCELERATOR_LISTEN"),
+		Relay:       os.Getenv("DOWNLOAD_ACCELERATOR_RELAY"),
+		Room:        os.Getenv("DOWNLOAD_ACCELERATOR_ROOM"),
+		WebSocket:   os.Getenv("DOWNLOAD_ACCELERATOR_WEBSOCKET"),
+		Fingerprint: os.Getenv("DOWNLOAD_ACCELERATOR_FINGERPRINT"),
+		PairingCode: os.Getenv("DOWNLOAD_ACCELERATOR_PAIRING_CODE"),
+	}
+	opts.MaxConnections, _ = strconv.Atoi(os.Getenv("DOWNLOAD_ACCELERATOR_MAX_CONNECTIONS"))
+	if mb, err := strconv.ParseInt(os.Getenv("DOWNLOAD_ACCELERATOR_MEMORY_BUDGET"), 10, 64); err == nil {
+		opts.MemoryBudget = mb * 1000 * 1000
+	}
+	return opts
+}
+
 func (d *Data) RunAgent(opts ...RunAgentOptions) error {
-	var id, ip, port string
+	var o RunAgentOptions
 	if len(opts) != 0 {
-		id = opts[0].ID
-		ip = opts[0].IP
-		port = opts[0].Port
+		o = opts[0]
 	} else {
-		id = os.Getenv("DOWNLOAD_ACCELERATOR_ID")
-		ip = os.Getenv("DOWNLOAD_ACCELERATOR_IP")
-		port = os.Getenv("DOWNLOAD_ACCELERATOR_PORT")
+		o = OptionsFromEnv()
+	}
+
+	id, ip, port, fingerprint, key := o.ID, o.IP, o.Port, o.Fingerprint, o.Key
+	if key == nil {
+		var err error
+		if key, err = identity.LoadOrCreate(keyFile()); err != nil {
+			return fmt.Errorf("cannot load the agent key: %w", err)
+		}
 	}
+	pub := key.Public().(ed25519.PublicKey)
 	if len(id) == 0 {
-		id = fmt.Sprintf("daa_%d", time.Now().UnixNano())
+		id = identity.ID(pub)
+	}
+
+	direct := len(o.Listen) == 0 && len(o.Relay) == 0 && len(o.WebSocket) == 0
+	if direct && len(ip) == 0 {
+		log.Println("Searching for the downloader on the local network...")
+		offer, err := discovery.Search(d.Ctx, id, protocolVersion)
+		if err != nil {
+			return err
+		}
+		// Any host can answer the search, so the certificate is only pinned
+		// from the environment and the pairing proof is only sent over TLS.
+		switch {
+		case len(fingerprint) == 0 && len(offer.Fingerprint) != 0:
+			return errors.New("the downloader uses TLS: set DOWNLOAD_ACCELERATOR_FINGERPRINT to its fingerprint")
+		case len(fingerprint) == 0 && len(o.PairingCode) != 0:
+			return errors.New("pairing with a downloader found by search requires DOWNLOAD_ACCELERATOR_FINGERPRINT or DOWNLOAD_ACCELERATOR_IP")
+		}
+		ip, port = offer.IP, offer.Port
+		log.Printf("Found the downloader at %s", net.JoinHostPort(ip, port))
 	}
-	if len(ip) == 0 || len(port) == 0 {
+	if direct && len(port) == 0 || len(o.Relay) != 0 && len(o.Room) == 0 {
 		return errors.New("check environemnts")
 	}
 
+	var config *tls.Config
+	if len(fingerprint) != 0 {
+		config = transport.ClientConfig(fingerprint)
+	}
+
+	// The downloader is the TLS server whichever side dials, so the agent
+	// pins its certificate in every mode.
+	var dial func() (net.Conn, error)
+	switch {
+	case len(o.WebSocket) != 0:
+		dial = func() (net.Conn, error) {
+			conn, err := transport.DialWebSocket(o.WebSocket)
+			if err != nil || config == nil {
+				return conn, err
+			}
+			return tls.Client(conn, config), nil
+		}
+	case len(o.Relay) != 0:
+		dial = func() (net.Conn, error) {
+			conn, err := relay.Dial(o.Relay, o.Room)
+			if err != nil || config == nil {
+				return conn, err
+			}
+			return tls.Client(conn, config), nil
+		}
+	case len(o.Listen) != 0:
+		// Anyone can dial a listening agent, so only a downloader holding
+		// the pinned certificate may drive it.
+		if config == nil {
+			return errors.New("listening for the downloader requires DOWNLOAD_ACCELERATOR_FINGERPRINT")
+		}
+		l, err := net.Listen("tcp", o.Listen)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		log.Printf("Waiting for the downloader on %s", l.Addr())
+
+		dial = func() (net.Conn, error) {
+			conn, err := l.Accept()
+			if err != nil {
+				return conn, err
+			}
+			_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+			return tls.Client(conn, config), nil
+		}
+	default:
+		addr := net.JoinHostPort(ip, port)
+		dial = func() (net.Conn, error) {
+			return transport.Dial(addr, config)
+		}
+	}
+
+	helloResp := helloResponse{
+		Version:        protocolVersion,
+		Build:          Build,
+		Codecs:         frame.Preferred,
+		MaxConnections: o.MaxConnections,
+		MemoryBudget:   o.MemoryBudget,
+		PublicKey:      pub,
+	}
+
+	sess := newSession()
+	sess.Hello = helloResp
+	helloResp.Session = sess.ID
+
+	var refused error
 	stop := false
-	tcp := newConnection(id, ip, port)
+	tcp, err := newConnection(d.Ctx, id, dial)
+	if err != nil {
+		return err
+	}
+	tcp.sendHello(helloResp)
 
 	go func() {
 		for !stop {
-			tcp.sendResponse(networkResponse{
+			sess.sendResponse(networkResponse{
 				Command:   keepAlive,
 				KeepAlive: keepAliveResponse{Command: keepAlive},
 			})
@@ -58,40 +228,74 @@ func (d *Data) RunAgent(opts ...RunAgentOptions) error {
 
 	go func() {
 		for !stop {
-			var resp networkResponse
-			if err := tcp.Decoder.Decode(&resp); err != nil {
-				tcp = newConnection(id, ip, port, tcp.Conn)
+			resp, err := tcp.readResponse(sess.ack)
+			if err != nil {
+				sess.lost(tcp)
+				tcp.Writer.Close()
+				next, err := newConnection(d.Ctx, id, dial, tcp.Conn)
+				if err != nil {
+					return
+				}
+				tcp = next
+				tcp.sendHello(helloResp)
 				continue
 			}
 
 			switch resp.Command {
-			case download:
-				data, err := tcp.download(resp.Download)
-				if err != nil {
-					tcp.sendResponse(networkResponse{Command: errorOccurred, Error: err})
-					continue
+			case challenge:
+				answer := challengeResponse{Signature: ed25519.Sign(key, resp.Challenge.Nonce)}
+				if len(o.PairingCode) != 0 {
+					answer.Pairing = identity.PairingProof(o.PairingCode, resp.Challenge.Nonce, pub)
 				}
-
-				var uploadResp []uploadResponse
-				for i, item := range data {
-					uploadResp = append(uploadResp, uploadResponse{
-						Type:     resp.Download[i].Type,
-						ID:       resp.Download[i].ID,
-						Filename: resp.Download[i].Filename,
-						Data:     item,
-					})
+				_ = tcp.sendResponse(networkResponse{
+					Command:   challenge,
+					Challenge: answer,
+				})
+			case hello:
+				if !resp.Hello.Accepted {
+					refused = fmt.Errorf("refused by the downloader: %s", resp.Hello.Reason)
+					d.Cancel()
+					return
+				}
+				codec, ok := frame.ParseCodec(resp.Hello.Codec)
+				if !ok {
+					refused = fmt.Errorf("the downloader chose an unknown codec %q", resp.Hello.Codec)
+					d.Cancel()
+					return
 				}
+				_ = tcp.Conn.SetDeadline(time.Time{})
+				tcp.Codec = codec
+				sess.setWindow(resp.Hello.Window)
+				go sess.resume(tcp)
+			case download:
+				// The download runs on its own so acks keep being read, and
+				// the upload is only reported once all of its data is stored.
+				go func(resp networkResponse) {
+					uploadResp, err := sess.download(resp.Job, resp.Download, resp.Settings)
+					if errors.Is(err, errCanceled) {
+						log.Printf("job %d: %s", resp.Job, err)
+						return
+					}
+					if err != nil {
+						log.Print(err)
+					}
 
-				tcp.sendResponse(networkResponse{
-					Command:  upload,
-					Upload:   uploadResp,
-					Settings: resp.Settings,
-				})
+					sess.waitAcked(resp.Job)
+					sess.deliver(networkResponse{
+						Job:     resp.Job,
+						Command: upload,
+						Upload:  uploadResp,
+					})
+				}(resp)
+			case cancelDownload:
+				sess.cancelJob(resp.Job)
 			}
 		}
 	}()
 
 	<-d.Ctx.Done()
 	stop = true
-	return nil
+	sess.close()
+	tcp.close()
+	return refused
 }
@@ -1,22 +1,29 @@
 package agent
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/yms2772/download_accelerator/frame"
+	"github.com/yms2772/download_accelerator/header"
+	"github.com/yms2772/download_accelerator/planner"
 )
 
 type downloader struct {
 	io.Reader
 
-	TCP           *tcpData
+	Transfer      *transfer
 	ProgressSent  time.Time
 	Index         int
 	ContentLength int64
@@ -24,28 +31,111 @@ type downloader struct {
 	PrevTotal     int64
 }
 
-var networkUsage []int64
+// partData is a range of a file downloaded by one connection. Last is -1 for
+// a stream of unknown length, which is read until the origin closes it.
+type partData struct {
+	Job    uint32
+	File   int
+	Index  int
+	Start  int64
+	Last   int64
+	URL    string
+	Stream bool
+	Done   bool
+	// Sampler decides whether the part is compressed.
+	Sampler sampler
+	// ETag and LastModified identify the version of the file the downloader
+	// probed. A response for another version fails the part with errChanged.
+	ETag         string
+	LastModified string
+	// Header is added to every request of the part.
+	Header http.Header
+}
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+
+	// minPartSize is the smallest range worth its own connection.
+	minPartSize = 256 << 10
+)
+
+// errRangeUnsupported means the origin answered a ranged request with the
+// whole file, so the part cannot be downloaded on its own.
+var errRangeUnsupported = errors.New("origin does not support range requests")
+
+// errChanged means the origin serves another version of the file than the
+// one the downloader probed, so the parts of the job would not fit together.
+var errChanged = errors.New("the file changed on the server")
+
+// errCanceled means the downloader canceled the job.
+var errCanceled = errors.New("the downloader canceled the job")
+
+// errSendFailed means the session with the downloader is closed, so
+// retrying the request would not help.
+var errSendFailed = errors.New("cannot send data to the downloader")
+
+// transfer is the state of one download request. A session may run several
+// at once, as when a new job starts while the parts of one that was given up
+// are still running, so they share nothing but the session.
+type transfer struct {
+	Session    *session
+	ChunkLimit chan struct{}
+	// Ctx is canceled when the downloader cancels the job.
+	Ctx context.Context
+
+	mu sync.Mutex
+	// usage is the speed of every part of the file being downloaded.
+	usage []int64
+}
+
+// sendData sends data with Session.sendData, waiting while ChunkLimit chunks
+// are already being sent.
+func (t *transfer) sendData(h frame.Header, data []byte, smp *sampler) error {
+	t.ChunkLimit <- struct{}{}
+	defer func() { <-t.ChunkLimit }()
+	return t.Session.sendData(h, data, smp)
+}
+
+// setUsage records the speed of part index and returns a copy of the speeds
+// of every part.
+func (t *transfer) setUsage(index int, speed int64) []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage[index] = speed
+	return append([]int64(nil), t.usage...)
+}
 
+// Read counts the bytes read from the origin and reports the speed of the
+// part about once a second. The report is sent on its own goroutine so a
+// slow connection to the downloader does not hold up the download.
 func (d *downloader) Read(p []byte) (int, error) {
 	n, err := d.Reader.Read(p)
-	go func() {
-		d.Total += int64(n)
-		if err == nil && time.Now().Sub(d.ProgressSent).Seconds() > 1 {
-			d.ProgressSent = time.Now()
-			networkUsage[d.Index] = d.Total - d.PrevTotal
-			d.PrevTotal = d.Total
-			d.TCP.sendResponse(networkResponse{
-				Command: progress,
-				Progress: progressResponse{
-					ID:           d.Index,
-					Command:      download,
-					Text:         fmt.Sprintf("Downloading... %s/s", humanize.Bytes(uint64(networkUsage[d.Index]))),
-					Percent:      float64(d.Total) / float64(d.ContentLength),
-					NetworkUsage: networkUsage,
-				},
-			})
-		}
-	}()
+	d.Total += int64(n)
+	if err != nil || time.Now().Sub(d.ProgressSent).Seconds() <= 1 {
+		return n, err
+	}
+
+	d.ProgressSent = time.Now()
+	speed := d.Total - d.PrevTotal
+	usage := d.Transfer.setUsage(d.Index, speed)
+	d.PrevTotal = d.Total
+	text := fmt.Sprintf("Downloading... %s/s", humanize.Bytes(uint64(speed)))
+	percent := float64(d.Total) / float64(d.ContentLength)
+	if d.ContentLength < 0 {
+		text = fmt.Sprintf("Downloading... %s, %s/s", humanize.Bytes(uint64(d.Total)), humanize.Bytes(uint64(speed)))
+		percent = -1
+	}
+	go d.Transfer.Session.sendResponse(networkResponse{
+		Command: progress,
+		Progress: progressResponse{
+			ID:           d.Index,
+			Command:      download,
+			Text:         text,
+			Percent:      percent,
+			NetworkUsage: usage,
+		},
+	})
 	return n, err
 }
 
@@ -53,89 +143,360 @@ func (d *downloader) Close() error {
 	return d.Close()
 }
 
-func (t *tcpData) download(responses []downloadResponse) ([][][]byte, error) {
+// download fetches every response and returns the ones that were completely
+// sent to the downloader.
+func (s *session) download(job uint32, responses []downloadResponse, settings settingsResponse) ([]uploadResponse, error) {
+	setting := settings.SplitTransferSetting
+	chunkSize := setting.ChunkSize * 1000 * 1000
+	if chunkSize <= 0 || chunkSize > frame.MaxPayload/2 {
+		chunkSize = frame.MaxPayload / 2
+	}
+	chunkParallel := setting.ChunkParallel
+	if chunkParallel <= 0 {
+		chunkParallel = 1
+	}
+	t := &transfer{Session: s, ChunkLimit: make(chan struct{}, chunkParallel), Ctx: s.jobContext(job)}
+
+	// Each connection buffers up to a chunk, so the memory budget announced
+	// in the hello also bounds the connections.
+	maxConnections := s.Hello.MaxConnections
+	if s.Hello.MemoryBudget > 0 {
+		n := int(s.Hello.MemoryBudget / int64(chunkSize))
+		if n < 1 {
+			n = 1
+		}
+		if maxConnections <= 0 || n < maxConnections {
+			maxConnections = n
+		}
+	}
+
+	var (
+		uploaded []uploadResponse
+		err      error
+	)
 	client := &http.Client{}
-	result := make([][][]byte, len(responses))
-	for i, resp := range responses {
-		result[i] = make([][]byte, resp.Connection)
+	for _, resp := range responses {
+		if maxConnections > 0 && resp.Connection > maxConnections {
+			resp.Connection = maxConnections
+		}
+		if len(resp.Header) != 0 {
+			log.Printf("file %d: requesting %s with %v", resp.File, resp.URL, header.Mask(resp.Header))
+		}
+		ranges := planner.Split(planner.Range{Start: resp.StartIndex, Last: resp.LastIndex}, resp.Connection, minPartSize)
+		parts := make([]partData, len(ranges))
 		wg := new(sync.WaitGroup)
-		total := resp.LastIndex - resp.StartIndex
-		parts := total / int64(resp.Connection)
-		networkUsage = make([]int64, resp.Connection)
-		for j := 0; j < resp.Connection; j++ {
+		t.mu.Lock()
+		t.usage = make([]int64, len(ranges))
+		t.mu.Unlock()
+		for j, r := range ranges {
 			wg.Add(1)
-			nextParts := resp.StartIndex + parts
-			if j == resp.Connection-1 {
-				nextParts = resp.LastIndex
+			parts[j] = partData{
+				Job:    job,
+				File:   resp.File,
+				Index:  j,
+				Start:  r.Start,
+				Last:   r.Last,
+				URL:    resp.URL,
+				Stream: resp.Stream,
+
+				ETag:         resp.ETag,
+				LastModified: resp.LastModified,
+				Header:       resp.Header,
 			}
-			go t.getPart(wg, client, &result[i][j], j, resp.StartIndex, nextParts, resp.URL)
-			resp.StartIndex = nextParts + 1
+			go t.getPart(wg, client, &parts[j], chunkSize, settings.RetrySetting)
 		}
 		wg.Wait()
+		if t.Ctx.Err() != nil {
+			return nil, errCanceled
+		}
 
-		for _, item := range result[i] {
-			if len(item) == 0 {
-				return nil, errors.New("download is not completely done")
+		done := true
+		for _, part := range parts {
+			if !part.Done {
+				done = false
+				err = errors.New("download is not completely done")
 			}
 		}
+		if done {
+			uploaded = append(uploaded, uploadResponse{
+				Type:       resp.Type,
+				ID:         resp.ID,
+				File:       resp.File,
+				Filename:   resp.Filename,
+				StartIndex: resp.StartIndex,
+				LastIndex:  parts[len(parts)-1].Last,
+			})
+		}
 	}
-	return result, nil
+	return uploaded, err
 }
 
-func (t *tcpData) getPart(wg *sync.WaitGroup, client *http.Client, data *[]byte, index int, start, last int64, uri string) {
+// retryDelay returns the exponential backoff before the next attempt with
+// jitter, so parts that failed together do not retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// getPart downloads the range of part and forwards it to the downloader while
+// the body is still arriving. A failed request is retried up to retry.Count
+// times, resuming from the last byte received; if every attempt fails the
+// error is reported to the downloader.
+func (t *transfer) getPart(wg *sync.WaitGroup, client *http.Client, part *partData, chunkSize int, retry retrySettingResponse) {
 	defer wg.Done()
 
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	buf := make([]byte, chunkSize)
+	offset := part.Start
+	attempt := 1
+	for part.Last < 0 || offset <= part.Last {
+		statusCode, err := t.fetchPart(client, part, &offset, buf)
+		if err == nil {
+			if part.Last < 0 {
+				part.Last = offset - 1
+				break
+			}
+			// the origin may send less than requested; ask for the rest
+			attempt = 1
+			continue
+		}
+		if errors.Is(err, errSendFailed) || t.Ctx.Err() != nil {
+			return
+		}
+		unsupported := errors.Is(err, errRangeUnsupported)
+		changed := errors.Is(err, errChanged)
+		if unsupported || changed || attempt > retry.Count {
+			log.Printf("part %d failed after %d attempt(s): %s", part.Index, attempt, err)
+			t.Session.deliver(networkResponse{
+				Job:     part.Job,
+				Command: partError,
+				PartError: partErrorResponse{
+					URL:              part.URL,
+					File:             part.File,
+					Part:             part.Index,
+					StartIndex:       offset,
+					LastIndex:        part.Last,
+					StatusCode:       statusCode,
+					Attempts:         attempt,
+					RangeUnsupported: unsupported,
+					Changed:          changed,
+					Error:            err.Error(),
+				},
+			})
+			return
+		}
+
+		t.Session.sendResponse(networkResponse{
+			Command: progress,
+			Progress: progressResponse{
+				ID:      part.Index,
+				Command: download,
+				Text:    fmt.Sprintf("Retrying (%d/%d)...", attempt, retry.Count),
+				Percent: -1,
+			},
+		})
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-t.Ctx.Done():
+			return
+		}
+		attempt++
+	}
+	part.Done = true
+
+	t.Session.sendResponse(networkResponse{
+		Command: progress,
+		Progress: progressResponse{
+			ID:      part.Index,
+			Command: download,
+			Text:    "Download complete",
+			Percent: 1,
+		},
+	})
+}
+
+// setValidators makes req conditional on the version of the file the
+// downloader probed. If-Match and If-Unmodified-Since make the origin answer
+// 412 when it changed; If-Range makes an origin that ignores them send the
+// whole new file rather than a range of it, which checkVersion then rejects.
+// A weak ETag cannot be used in either, so Last-Modified is used instead.
+func setValidators(req *http.Request, part *partData) {
+	ranged := len(req.Header.Get("Range")) != 0
+	switch {
+	case len(part.ETag) != 0 && !strings.HasPrefix(part.ETag, "W/"):
+		req.Header.Set("If-Match", part.ETag)
+		if ranged {
+			req.Header.Set("If-Range", part.ETag)
+		}
+	case len(part.LastModified) != 0:
+		req.Header.Set("If-Unmodified-Since", part.LastModified)
+		if ranged {
+			req.Header.Set("If-Range", part.LastModified)
+		}
+	}
+}
+
+// checkVersion returns errChanged when resp is for another version of the
+// file than the one of part, whether the origin says so with 412 or a CDN edge
+// ignored the conditions and serves an object with other validators.
+func checkVersion(resp *http.Response, part *partData) error {
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: precondition failed", errChanged)
+	}
+	if etag := resp.Header.Get("ETag"); len(part.ETag) != 0 && len(etag) != 0 {
+		if strings.TrimPrefix(etag, "W/") != strings.TrimPrefix(part.ETag, "W/") {
+			return fmt.Errorf("%w: ETag %s, expected %s", errChanged, etag, part.ETag)
+		}
+		return nil
+	}
+	if modified := resp.Header.Get("Last-Modified"); len(part.ETag) == 0 && len(part.LastModified) != 0 && len(modified) != 0 && modified != part.LastModified {
+		return fmt.Errorf("%w: last modified %s, expected %s", errChanged, modified, part.LastModified)
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-last/total". total is -1 when the length is unknown.
+func parseContentRange(s string) (start, last, total int64, err error) {
+	var size string
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%s", &start, &last, &size); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	if start < 0 || last < start {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= last {
+			return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+		}
+	}
+	return start, last, total, nil
+}
+
+// fetchPart requests the bytes of part from offset and sends them in data
+// frames of len(buf) bytes, advancing offset as they are sent. The response
+// has to be a 206 whose Content-Range starts at offset and stays inside the
+// part; a 200 is only usable by the part that starts the file or by a single
+// stream, which skip the bytes already received. It returns the status code
+// of the response.
+func (t *transfer) fetchPart(client *http.Client, part *partData, offset *int64, buf []byte) (int, error) {
+	req, err := http.NewRequestWithContext(t.Ctx, http.MethodGet, part.URL, nil)
 	if err != nil {
-		return
+		return 0, err
+	}
+	for name, values := range part.Header {
+		req.Header[name] = values
 	}
 
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", start, last))
+	switch {
+	case part.Last >= 0:
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", *offset, part.Last))
+	case *offset > 0:
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", *offset))
+	}
+	setValidators(req, part)
 
 	resp, err := client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return
+		return 0, err
+	}
+	if err := checkVersion(resp, part); err != nil {
+		return resp.StatusCode, err
 	}
 
-	resp.Body = &downloader{
-		TCP:           t,
+	var length int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return resp.StatusCode, err
+		}
+		if part.Last < 0 && total >= 0 {
+			part.Last = total - 1
+		}
+		if start != *offset || (part.Last >= 0 && last > part.Last) {
+			return resp.StatusCode, fmt.Errorf("requested bytes %d-%d, got %q", *offset, part.Last, resp.Header.Get("Content-Range"))
+		}
+		length = last - start + 1
+		if resp.ContentLength >= 0 && resp.ContentLength != length {
+			return resp.StatusCode, fmt.Errorf("content length %d does not match %q", resp.ContentLength, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The origin ignored the Range header and sent the whole file.
+		if part.Start != 0 && !part.Stream {
+			return resp.StatusCode, errRangeUnsupported
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength <= part.Last {
+			return resp.StatusCode, fmt.Errorf("content length %d is shorter than the part", resp.ContentLength)
+		}
+		if part.Last < 0 && resp.ContentLength >= 0 {
+			part.Last = resp.ContentLength - 1
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, *offset); err != nil {
+			return resp.StatusCode, err
+		}
+		length = part.Last - *offset + 1
+		if part.Last < 0 {
+			length = -1
+		}
+	default:
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body := &downloader{
+		Transfer:      t,
 		ProgressSent:  time.Now(),
-		Index:         index,
+		Index:         part.Index,
 		Reader:        resp.Body,
-		ContentLength: last - start,
+		ContentLength: part.Last - part.Start,
+		Total:         *offset - part.Start,
+		PrevTotal:     *offset - part.Start,
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
+	end := *offset + length
+	if length < 0 {
+		body.ContentLength = -1
+		end = math.MaxInt64
+	} else {
+		body.Reader = io.LimitReader(resp.Body, length)
 	}
 
-	t.sendResponse(networkResponse{
-		Command: progress,
-		Progress: progressResponse{
-			ID:      index,
-			Command: compress,
-			Text:    "Compressing...",
-		},
-	})
-
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	_, _ = gz.Write(body)
-	_ = gz.Close()
-
-	*data = buf.Bytes()
+	for *offset < end {
+		n, err := io.ReadFull(body, buf)
+		if t.Ctx.Err() != nil {
+			return resp.StatusCode, errCanceled
+		}
+		if n > 0 {
+			if err := t.sendData(frame.Header{
+				Command: frame.Data,
+				Job:     part.Job,
+				File:    uint16(part.File),
+				Part:    uint32(part.Index),
+				Offset:  *offset,
+			}, buf[:n], &part.Sampler); err != nil {
+				return resp.StatusCode, errSendFailed
+			}
+			*offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return resp.StatusCode, err
+		}
+	}
 
-	t.sendResponse(networkResponse{
-		Command: progress,
-		Progress: progressResponse{
-			ID:      index,
-			Command: download,
-			Text:    "Download complete",
-			Percent: 1,
-		},
-	})
+	if length >= 0 && *offset < end {
+		return resp.StatusCode, io.ErrUnexpectedEOF
+	}
+	return resp.StatusCode, nil
 }
@@ -1,18 +1,28 @@
 package agent
 
+import "net/http"
+
 type commandType string
 type fileType string
 
 const (
 	upload        commandType = "upload"
 	download      commandType = "download"
-	compress      commandType = "compress"
 	progress      commandType = "progress"
 	errorOccurred commandType = "error"
 	keepAlive     commandType = "keep_alive"
-	splitTransfer commandType = "split_transfer"
+	partError     commandType = "part_error"
+	hello         commandType = "hello"
+	challenge     commandType = "challenge"
+	// cancelDownload tells an agent to stop every download of the job.
+	cancelDownload commandType = "cancel"
 )
 
+// protocolVersion is exchanged in the hello of every connection. Bump it
+// whenever networkResponse or the frame format changes in a way an older peer
+// cannot read.
+const protocolVersion = 6
+
 type keepAliveResponse struct {
 	Command commandType `json:"command"`
 }
@@ -21,18 +31,26 @@ type downloadResponse struct {
 	Type          fileType `json:"type"`
 	URL           string   `json:"url"`
 	ID            int      `json:"id"`
+	File          int      `json:"file"`
 	Filename      string   `json:"filename"`
 	Connection    int      `json:"connection"`
 	ContentLength int64    `json:"content_length"`
+	ETag          string   `json:"etag"`
+	LastModified  string   `json:"last_modified"`
+	Stream        bool     `json:"stream"`
 	StartIndex    int64    `json:"start_index"`
 	LastIndex     int64    `json:"last_index"`
+	// Header holds the headers the user added to the requests for URL.
+	Header http.Header `json:"header,omitempty"`
 }
 
 type uploadResponse struct {
-	Type     fileType `json:"type"`
-	ID       int      `json:"id"`
-	Filename string   `json:"filename"`
-	Data     [][]byte `json:"data"`
+	Type       fileType `json:"type"`
+	ID         int      `json:"id"`
+	File       int      `json:"file"`
+	Filename   string   `json:"filename"`
+	StartIndex int64    `json:"start_index"`
+	LastIndex  int64    `json:"last_index"`
 }
 
 type progressResponse struct {
@@ -43,30 +61,75 @@ type progressResponse struct {
 	NetworkUsage []int64     `json:"network_usage"`
 }
 
-type splitTransferResponse struct {
-	Index int64  `json:"index"`
-	Total int64  `json:"total"`
-	Done  bool   `json:"done"`
-	Data  []byte `json:"data"`
-}
-
 type splitTransferSettingResponse struct {
 	ChunkSize     int `json:"chunk_size"`
 	ChunkParallel int `json:"chunk_parallel"`
 }
 
+type retrySettingResponse struct {
+	Count int `json:"count"`
+}
+
 type settingsResponse struct {
 	SplitTransferSetting splitTransferSettingResponse `json:"split_transfer_setting"`
+	RetrySetting         retrySettingResponse         `json:"retry_setting"`
+}
+
+type partErrorResponse struct {
+	URL              string `json:"url"`
+	File             int    `json:"file"`
+	Part             int    `json:"part"`
+	StartIndex       int64  `json:"start_index"`
+	LastIndex        int64  `json:"last_index"`
+	StatusCode       int    `json:"status_code"`
+	Attempts         int    `json:"attempts"`
+	RangeUnsupported bool   `json:"range_unsupported"`
+	Changed          bool   `json:"changed"`
+	Error            string `json:"error"`
+}
+
+// helloResponse is the first message an agent sends on a connection. Once the
+// agent has answered the challenge, the downloader replies with Accepted, the
+// codec to use for data frames and, when it refuses the agent, the Reason.
+type helloResponse struct {
+	Version        int      `json:"version"`
+	Build          string   `json:"build"`
+	Codecs         []string `json:"codecs"`
+	MaxConnections int      `json:"max_connections"`
+	MemoryBudget   int64    `json:"memory_budget"`
+	PublicKey      []byte   `json:"public_key"`
+	// Session is chosen by the agent when it starts. A reconnection with the
+	// same session resumes the uploads of the previous connection.
+	Session  string `json:"session"`
+	Accepted bool   `json:"accepted"`
+	Codec    string `json:"codec"`
+	Reason   string `json:"reason"`
+	// Window is the number of bytes the downloader buffers for the agent.
+	// The agent holds back data frames while those it sent and the
+	// downloader did not acknowledge yet would exceed it. Zero means no limit.
+	Window int64 `json:"window"`
+}
+
+// challengeResponse carries the Nonce the downloader sends after a hello and
+// the answer of the agent: the Signature of the nonce with its key and, while
+// the agent is not paired yet, the Pairing proof of the pairing code.
+type challengeResponse struct {
+	Nonce     []byte `json:"nonce"`
+	Signature []byte `json:"signature"`
+	Pairing   []byte `json:"pairing"`
 }
 
 type networkResponse struct {
-	ID            string                `json:"id"`
-	Command       commandType           `json:"command"`
-	KeepAlive     keepAliveResponse     `json:"keep_alive"`
-	Download      []downloadResponse    `json:"download"`
-	Upload        []uploadResponse      `json:"upload"`
-	Progress      progressResponse      `json:"progress"`
-	SplitTransfer splitTransferResponse `json:"splitTransfer"`
-	Settings      settingsResponse      `json:"settings"`
-	Error         error                 `json:"error"`
+	ID        string             `json:"id"`
+	Job       uint32             `json:"job"`
+	Command   commandType        `json:"command"`
+	Hello     helloResponse      `json:"hello"`
+	Challenge challengeResponse  `json:"challenge"`
+	KeepAlive keepAliveResponse  `json:"keep_alive"`
+	Download  []downloadResponse `json:"download"`
+	Upload    []uploadResponse   `json:"upload"`
+	Progress  progressResponse   `json:"progress"`
+	Settings  settingsResponse   `json:"settings"`
+	PartError partErrorResponse  `json:"part_error"`
+	Error     string             `json:"error"`
 }
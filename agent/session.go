@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/yms2772/download_accelerator/frame"
+)
+
+type segmentKey struct {
+	Job    uint32
+	File   uint16
+	Offset int64
+}
+
+type segment struct {
+	Header  frame.Header
+	Payload []byte
+}
+
+// session keeps the uploads of the agent across its connections to the
+// downloader. Data frames stay in unacked until the downloader acknowledges
+// them and are sent again on the next connection, so an upload cut by a
+// reconnection resumes where it stopped instead of starting over. They also
+// count against the window of the downloader: sendData waits while inflight
+// bytes would exceed it.
+type session struct {
+	ID    string
+	Hello helloResponse
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	tcp      *tcpData
+	closed   bool
+	unacked  map[segmentKey]segment
+	inflight int64
+	window   int64
+	// jobs holds the context of the downloads of every job, canceled when
+	// the downloader cancels the job.
+	jobs map[uint32]jobContext
+}
+
+type jobContext struct {
+	Ctx    context.Context
+	Cancel context.CancelFunc
+}
+
+func newSession() *session {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	s := &session{
+		ID:      hex.EncodeToString(b),
+		unacked: make(map[segmentKey]segment),
+		jobs:    make(map[uint32]jobContext),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func keyOf(h frame.Header) segmentKey {
+	return segmentKey{Job: h.Job, File: h.File, Offset: h.Offset}
+}
+
+// current waits for a connection accepted by the downloader. It returns nil
+// once the session is closed.
+func (s *session) current() *tcpData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.tcp == nil && !s.closed {
+		s.cond.Wait()
+	}
+	return s.tcp
+}
+
+// resume sends the frames that were not acknowledged on tcp, a connection the
+// downloader just accepted, and then makes it the connection of the session.
+func (s *session) resume(tcp *tcpData) {
+	s.mu.Lock()
+	pending := make([]segment, 0, len(s.unacked))
+	for _, seg := range s.unacked {
+		pending = append(pending, seg)
+	}
+	s.mu.Unlock()
+
+	for _, seg := range pending {
+		if err := tcp.Writer.Write(seg.Header, seg.Payload); err != nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.tcp = tcp
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// setWindow applies the window of the downloader, zero for no limit.
+func (s *session) setWindow(window int64) {
+	s.mu.Lock()
+	s.window = window
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// lost detaches tcp from the session until the next connection is resumed.
+func (s *session) lost(tcp *tcpData) {
+	s.mu.Lock()
+	if s.tcp == tcp {
+		s.tcp = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// jobContext returns the context of the downloads of job.
+func (s *session) jobContext(job uint32) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.job(job).Ctx
+}
+
+// cancelJob stops the downloads of job, including the ones the downloader
+// sent before the cancel but the agent has not started yet.
+func (s *session) cancelJob(job uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.job(job).Cancel()
+}
+
+// job must be called with s.mu held.
+func (s *session) job(job uint32) jobContext {
+	j, ok := s.jobs[job]
+	if !ok {
+		j.Ctx, j.Cancel = context.WithCancel(context.Background())
+		s.jobs[job] = j
+	}
+	return j
+}
+
+// ack forgets the data frame acknowledged by h.
+func (s *session) ack(h frame.Header) {
+	s.mu.Lock()
+	key := keyOf(h)
+	if seg, ok := s.unacked[key]; ok {
+		s.inflight -= int64(len(seg.Payload))
+		delete(s.unacked, key)
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// waitAcked waits until the downloader acknowledged every data frame of job.
+func (s *session) waitAcked(job uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed {
+		pending := false
+		for key := range s.unacked {
+			if key.Job == job {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return
+		}
+		s.cond.Wait()
+	}
+}
+
+// sendResponse sends data on the current connection and drops it while the
+// agent is reconnecting. It is meant for keep-alives and progress.
+func (s *session) sendResponse(data networkResponse) {
+	s.mu.Lock()
+	tcp := s.tcp
+	s.mu.Unlock()
+	if tcp != nil {
+		_ = tcp.sendResponse(data)
+	}
+}
+
+// deliver sends data, waiting for the next connection when there is none or
+// the write fails.
+func (s *session) deliver(data networkResponse) {
+	for {
+		tcp := s.current()
+		if tcp == nil || tcp.sendResponse(data) == nil {
+			return
+		}
+		s.lost(tcp)
+	}
+}
+
+// reserve waits for the window to take payload and keeps it until it is
+// acknowledged. A frame is always let through when nothing is in flight, so a
+// window smaller than a frame slows the agent down without stopping it. It
+// returns false once the session is closed.
+func (s *session) reserve(h frame.Header, payload []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.window > 0 && s.inflight > 0 && s.inflight+int64(len(payload)) > s.window && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return false
+	}
+
+	key := keyOf(h)
+	if seg, ok := s.unacked[key]; ok {
+		s.inflight -= int64(len(seg.Payload))
+	}
+	s.unacked[key] = segment{Header: h, Payload: payload}
+	s.inflight += int64(len(payload))
+	return true
+}
+
+// sendData encodes data with the codec of the current connection, unless smp
+// found that the part does not compress, and sends it in frames of up to
+// segmentSize bytes, waiting while the window of the downloader is full. A
+// frame that cannot be written is sent again once the agent is reconnected.
+func (s *session) sendData(h frame.Header, data []byte, smp *sampler) error {
+	tcp := s.current()
+	if tcp == nil {
+		return errSendFailed
+	}
+	codec := tcp.Codec
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > segmentSize {
+			chunk = chunk[:segmentSize]
+		}
+		// chunk is reused by the caller, the sealed payload is a copy kept
+		// until it is acknowledged
+		h.Codec = frame.CodecNone
+		encoded := chunk
+		if codec != frame.CodecNone && !smp.Off {
+			compressed := frame.Lookup(codec).Encode(chunk)
+			if smp.add(len(chunk), len(compressed)) {
+				log.Printf("part %d of file %d does not compress, sending the rest as is", h.Part, h.File)
+			}
+			if len(compressed) < len(chunk) {
+				h.Codec, encoded = codec, compressed
+			}
+		}
+		payload := frame.Seal(chunk, encoded)
+
+		if !s.reserve(h, payload) {
+			return errSendFailed
+		}
+		if tcp = s.current(); tcp == nil {
+			return errSendFailed
+		}
+		if err := tcp.Writer.Write(h, payload); err != nil {
+			s.lost(tcp)
+			if s.current() == nil {
+				return errSendFailed
+			}
+		}
+
+		h.Offset += int64(len(chunk))
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+const (
+	// sampleSize is how much of a part is compressed before deciding
+	// whether the rest is worth compressing.
+	sampleSize = 2 << 20
+	// minSaving is the fraction of the sample compression has to save.
+	minSaving = 0.05
+)
+
+// sampler turns compression off for the rest of a part when its first
+// sampleSize bytes do not compress, as with video or archives.
+type sampler struct {
+	Raw     int64
+	Encoded int64
+	Off     bool
+}
+
+// add counts a segment of the sample and reports whether it turned
+// compression off.
+func (smp *sampler) add(raw, encoded int) bool {
+	if smp.Raw >= sampleSize {
+		return false
+	}
+	smp.Raw += int64(raw)
+	smp.Encoded += int64(encoded)
+	smp.Off = smp.Raw >= sampleSize && float64(smp.Encoded) > float64(smp.Raw)*(1-minSaving)
+	return smp.Off
+}
@@ -1,37 +1,52 @@
 package agent
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"log"
 	"net"
-	"sync"
 	"time"
+
+	"github.com/yms2772/download_accelerator/frame"
 )
 
 type tcpData struct {
-	ID      string
-	Conn    net.Conn
-	Decoder *json.Decoder
+	ID     string
+	Conn   net.Conn
+	Reader *bufio.Reader
+	Writer *frame.Writer
+	Codec  uint8
 }
 
-func newConnection(id, ip, port string, preConn ...net.Conn) *tcpData {
+// segmentSize bounds the data frames, so a control frame waits for at most
+// one segment on the connection whatever the chunk size.
+const segmentSize = 256 << 10
+
+// newConnection calls dial until it returns a connection to the downloader or
+// ctx is done.
+func newConnection(ctx context.Context, id string, dial func() (net.Conn, error), preConn ...net.Conn) (*tcpData, error) {
 	log.Println("Wait for new connection...")
 	if len(preConn) != 0 {
 		_ = preConn[0].Close()
 	}
 
-	conn, err := net.DialTimeout("tcp", ip+":"+port, 5*time.Second)
-	for err != nil {
-		conn, err = net.DialTimeout("tcp", ip+":"+port, 5*time.Second)
-		if err != nil {
-			if conn != nil {
-				_ = conn.Close()
-			}
+	var lastErr string
+	for {
+		conn, err := dial()
+		if err == nil {
+			log.Printf("TCP connected: %s <> %s", conn.LocalAddr(), conn.RemoteAddr())
+			return &tcpData{ID: id, Conn: conn, Reader: bufio.NewReader(conn), Writer: frame.NewWriter(conn)}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err.Error() != lastErr {
+			lastErr = err.Error()
+			log.Print(err)
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
-	log.Printf("TCP connected: %s <> %s", conn.LocalAddr(), conn.RemoteAddr())
-	return &tcpData{ID: id, Conn: conn, Decoder: json.NewDecoder(conn)}
 }
 
 func makeResponse(data networkResponse) []byte {
@@ -39,76 +54,44 @@ func makeResponse(data networkResponse) []byte {
 	return jsonData
 }
 
-func (t *tcpData) sendResponse(data networkResponse) {
-	data.ID = t.ID
-	jsonData := makeResponse(data)
+// readResponse returns the next control message. Ack frames read on the way
+// are passed to ack and any other frame is skipped.
+func (t *tcpData) readResponse(ack func(frame.Header)) (networkResponse, error) {
+	for {
+		h, payload, err := frame.Read(t.Reader)
+		if err != nil {
+			return networkResponse{}, err
+		}
+		if h.Command == frame.Ack {
+			ack(h)
+			continue
+		}
+		if h.Command != frame.Control {
+			continue
+		}
 
-	if data.Command == upload {
-		t.sendResponse(networkResponse{
-			Command: progress,
-			Progress: progressResponse{
-				Command: splitTransfer,
-				Text:    "Receiving data from client...",
-			},
-		})
+		var resp networkResponse
+		err = json.Unmarshal(payload, &resp)
+		return resp, err
+	}
+}
 
-		limit := int64(data.Settings.SplitTransferSetting.ChunkSize * 1000 * 1000)
-		total := int64(len(jsonData))
-		count := int64(0)
-		var splitData []byte
-		var splitMergedData [][]byte
-		for i := int64(0); i < total; i++ {
-			splitData = append(splitData, jsonData[i])
-			if int64(len(splitData)) > limit || i == total-1 {
-				count++
-				splitMergedData = append(splitMergedData, splitData)
-				splitData = []byte{}
-			}
-		}
+func (t *tcpData) sendResponse(data networkResponse) error {
+	data.ID = t.ID
+	return t.Writer.Write(frame.Header{Command: frame.Control}, makeResponse(data))
+}
 
-		_, _ = t.Conn.Write(makeResponse(networkResponse{
-			ID:      t.ID,
-			Command: splitTransfer,
-			SplitTransfer: splitTransferResponse{
-				Index: -1,
-				Total: count,
-				Done:  false,
-			},
-		}))
+// close stops the writer and closes the connection.
+func (t *tcpData) close() {
+	t.Writer.Close()
+	_ = t.Conn.Close()
+}
 
-		wgCount := 0
-		wg := new(sync.WaitGroup)
-		for i := int64(0); i < count; i++ {
-			wgCount++
-			wg.Add(1)
-			go func(index int64) {
-				defer wg.Done()
-				_, _ = t.Conn.Write(makeResponse(networkResponse{
-					ID:      t.ID,
-					Command: splitTransfer,
-					SplitTransfer: splitTransferResponse{
-						Index: index,
-						Total: count,
-						Data:  splitMergedData[index],
-						Done:  false,
-					},
-				}))
-			}(i)
-			if wgCount%data.Settings.SplitTransferSetting.ChunkParallel == 0 {
-				wg.Wait()
-			}
-		}
-		wg.Wait()
-		_, _ = t.Conn.Write(makeResponse(networkResponse{
-			ID:      t.ID,
-			Command: splitTransfer,
-			SplitTransfer: splitTransferResponse{
-				Index: count,
-				Total: count,
-				Done:  true,
-			},
-		}))
-	} else {
-		_, _ = t.Conn.Write(jsonData)
-	}
+// sendHello announces the agent to the downloader. It must be the first
+// message on the connection.
+func (t *tcpData) sendHello(h helloResponse) {
+	_ = t.sendResponse(networkResponse{
+		Command: hello,
+		Hello:   h,
+	})
 }
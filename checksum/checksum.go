@@ -0,0 +1,193 @@
+// Package checksum verifies downloaded files against the digests their
+// publishers provide, given by the user or found next to the file.
+package checksum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSumsSize bounds the digest files read by Discover.
+const maxSumsSize = 1 << 20
+
+var ErrNotFound = errors.New("no checksum found next to the file")
+
+var algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// bySize guesses the algorithm of a bare hex digest from its length.
+var bySize = map[int]string{
+	md5.Size:    "md5",
+	sha1.Size:   "sha1",
+	sha256.Size: "sha256",
+	sha512.Size: "sha512",
+}
+
+type Digest struct {
+	Algorithm string
+	Sum       []byte
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + ":" + hex.EncodeToString(d.Sum)
+}
+
+// Parse reads a digest written as "algorithm:hex", e.g. "sha256:9f86...", or
+// as bare hex, whose length tells the algorithm.
+func Parse(s string) (Digest, error) {
+	s = strings.TrimSpace(s)
+	algorithm := ""
+	if i := strings.IndexAny(s, ":="); i >= 0 {
+		algorithm, s = strings.ToLower(strings.TrimSpace(s[:i])), strings.TrimSpace(s[i+1:])
+		algorithm = strings.ReplaceAll(algorithm, "-", "")
+	}
+
+	sum, err := hex.DecodeString(s)
+	if err != nil {
+		return Digest{}, fmt.Errorf("invalid checksum %q", s)
+	}
+	if len(algorithm) == 0 {
+		algorithm = bySize[len(sum)]
+	}
+	newHash, ok := algorithms[algorithm]
+	if !ok {
+		return Digest{}, fmt.Errorf("unsupported checksum %q: use md5, sha1, sha256 or sha512", s)
+	}
+	if newHash().Size() != len(sum) {
+		return Digest{}, fmt.Errorf("a %s checksum has %d hex digits", algorithm, 2*newHash().Size())
+	}
+	return Digest{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// File computes the digest of the file at path with the algorithm of d.
+func (d Digest) File(path string) (Digest, error) {
+	newHash, ok := algorithms[d.Algorithm]
+	if !ok {
+		return Digest{}, fmt.Errorf("unsupported algorithm %q", d.Algorithm)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Digest{}, err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return Digest{}, err
+	}
+	return Digest{Algorithm: d.Algorithm, Sum: h.Sum(nil)}, nil
+}
+
+// Equal reports whether d and o are the same digest.
+func (d Digest) Equal(o Digest) bool {
+	return d.Algorithm == o.Algorithm && bytes.Equal(d.Sum, o.Sum)
+}
+
+// Discover looks for the digest of the file at rawURL among the files
+// published next to it: rawURL followed by .sha256, .sha512 or .md5, then the
+// SHA256SUMS, SHA512SUMS and MD5SUMS lists of its directory. It returns the
+// digest and the URL it was found at, or ErrNotFound.
+func Discover(client *http.Client, rawURL string) (Digest, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Digest{}, "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return Digest{}, "", ErrNotFound
+	}
+
+	var candidates []string
+	for _, ext := range []string{".sha256", ".sha512", ".md5"} {
+		sidecar := *u
+		sidecar.Path += ext
+		sidecar.RawPath = ""
+		candidates = append(candidates, sidecar.String())
+	}
+	for _, list := range []string{"SHA256SUMS", "SHA512SUMS", "MD5SUMS"} {
+		sums := *u
+		sums.Path = path.Join(path.Dir(u.Path), list)
+		sums.RawPath = ""
+		sums.RawQuery = ""
+		candidates = append(candidates, sums.String())
+	}
+
+	for _, candidate := range candidates {
+		body, err := fetch(client, candidate)
+		if err != nil {
+			continue
+		}
+		if d, ok := lookup(body, name); ok {
+			return d, candidate, nil
+		}
+	}
+	return Digest{}, "", ErrNotFound
+}
+
+func fetch(client *http.Client, rawURL string) ([]byte, error) {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSumsSize))
+}
+
+// lookup finds the digest of name in a digest file. It understands the
+// "digest  name" lines of sha256sum, "SHA256 (name) = digest" lines of BSD
+// tools, and a sidecar holding nothing but the digest.
+func lookup(body []byte, name string) (Digest, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	var lines int
+	var only Digest
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines++
+
+		// the BSD form, "SHA256 (name) = hex"; the name may hold parentheses
+		if i, j := strings.Index(line, " ("), strings.LastIndex(line, ") ="); i > 0 && i+2 <= j {
+			if path.Base(line[i+2:j]) == name {
+				d, err := Parse(line[:i] + ":" + line[j+3:])
+				return d, err == nil
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			only, _ = Parse(fields[0])
+			continue
+		}
+		if path.Base(strings.TrimPrefix(fields[len(fields)-1], "*")) == name {
+			d, err := Parse(fields[0])
+			return d, err == nil
+		}
+	}
+	return only, lines == 1 && len(only.Sum) != 0
+}
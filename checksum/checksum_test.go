@@ -0,0 +1,85 @@
+package checksum
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	md5Hex    = strings.Repeat("0a", 16)
+	sha1Hex   = strings.Repeat("1b", 20)
+	sha256Hex = strings.Repeat("2c", 32)
+	sha512Hex = strings.Repeat("3d", 64)
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in        string
+		algorithm string
+		ok        bool
+	}{
+		{"sha256:" + sha256Hex, "sha256", true},
+		{"SHA-256: " + strings.ToUpper(sha256Hex), "sha256", true},
+		{"sha512=" + sha512Hex, "sha512", true},
+		{"  " + sha256Hex + "\n", "sha256", true},
+		{md5Hex, "md5", true},
+		{sha1Hex, "sha1", true},
+		{sha512Hex, "sha512", true},
+		{"", "", false},
+		{"not hex", "", false},
+		{sha256Hex[1:], "", false},
+		{"sha256:" + md5Hex, "", false},
+		{"crc32:" + md5Hex[:8], "", false},
+		{strings.Repeat("ab", 7), "", false},
+	}
+	for _, test := range tests {
+		d, err := Parse(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("Parse(%q): error %v", test.in, err)
+			continue
+		}
+		if d.Algorithm != test.algorithm {
+			t.Errorf("Parse(%q) = %s, want %s", test.in, d.Algorithm, test.algorithm)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"sha256sum", sha256Hex + "  file.iso\n", "sha256:" + sha256Hex},
+		{"sha256sum binary", sha256Hex + " *file.iso\n", "sha256:" + sha256Hex},
+		{"sha256sum path", sha256Hex + "  release/file.iso\n", "sha256:" + sha256Hex},
+		{"sha256sum list", md5Hex + "  other.iso\n" + sha512Hex + "  file.iso\n", "sha512:" + sha512Hex},
+		{"sha256sum missing", sha256Hex + "  other.iso\n", ""},
+		{"bsd", "SHA256 (file.iso) = " + sha256Hex + "\n", "sha256:" + sha256Hex},
+		{"bsd list", "SHA1 (other.iso) = " + sha1Hex + "\nSHA1 (file.iso) = " + sha1Hex, "sha1:" + sha1Hex},
+		{"bsd bad digest", "SHA256 (file.iso) = nothex", ""},
+		{"bare", sha256Hex + "\n", "sha256:" + sha256Hex},
+		{"bare comment", "# file.iso\n" + md5Hex, "md5:" + md5Hex},
+		{"bare among others", sha256Hex + "\n" + sha256Hex + "\n", ""},
+		{"empty", "", ""},
+		{"html", "<html>\n<body>Not Found</body>\n</html>\n", ""},
+		{"malformed", "x) = (y\n", ""},
+		{"malformed name", "SHA256 (file.iso) (y\n", ""},
+		{"malformed close", ") = (\n", ""},
+	}
+	for _, test := range tests {
+		d, ok := lookup([]byte(test.body), "file.iso")
+		got := ""
+		if ok {
+			got = d.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: lookup = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	d, ok := lookup([]byte("MD5 (file (1).iso) = "+md5Hex), "file (1).iso")
+	if !ok || d.String() != "md5:"+md5Hex {
+		t.Errorf("bsd parentheses: lookup = %v, %v", d, ok)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// discoveredTimeout is how long an agent stays in the client list after its
+// last search for the downloader.
+const discoveredTimeout = 5 * time.Second
+
+var (
+	discoveredMu sync.Mutex
+	discovered   = make(map[string]time.Time)
+)
+
+// clientRow is the checkbox of a client in the client list with the outcome
+// of its handshake next to it. Discovered rows list agents that search for
+// the downloader but are not connected.
+type clientRow struct {
+	widget.BaseWidget
+	Check      *widget.Check
+	Status     *widget.Label
+	Discovered bool
+}
+
+func newClientRow(id string) *clientRow {
+	row := &clientRow{
+		Check:  widget.NewCheck(id, func(b bool) {}),
+		Status: widget.NewLabel(""),
+	}
+	row.Status.TextStyle.Italic = true
+	row.ExtendBaseWidget(row)
+	return row
+}
+
+func (r *clientRow) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(container.NewHBox(r.Check, r.Status))
+}
+
+// clientRows returns every row of the client list, including hidden ones.
+func (m *mainAppData) clientRows() []*clientRow {
+	var rows []*clientRow
+	for _, object := range m.Client.Content.(*fyne.Container).Objects {
+		if row, ok := object.(*clientRow); ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// clientRow returns the row of the client id, or nil if it never connected.
+func (m *mainAppData) clientRow(id string) *clientRow {
+	for _, row := range m.clientRows() {
+		if row.Check.Text == id {
+			return row
+		}
+	}
+	return nil
+}
+
+// showClient shows the row of the client id with status, adding it to the
+// client list the first time. A refused client cannot be checked.
+func (m *mainAppData) showClient(id, status string, accepted bool) {
+	row := m.clientRow(id)
+	if row == nil {
+		row = newClientRow(id)
+		m.Client.Content.(*fyne.Container).Add(row)
+	}
+
+	row.Discovered = false
+	row.Status.SetText(status)
+	if accepted {
+		row.Check.Enable()
+	} else {
+		row.Check.SetChecked(false)
+		row.Check.Disable()
+	}
+	row.Show()
+	m.Client.Refresh()
+}
+
+// discover lists the agent id found searching from addr, unless it is
+// connected or its row already shows why it was refused.
+func (m *mainAppData) discover(id string, addr *net.UDPAddr) {
+	if _, ok := findConnection(id); ok || len(id) == 0 {
+		return
+	}
+
+	discoveredMu.Lock()
+	discovered[id] = time.Now()
+	discoveredMu.Unlock()
+
+	row := m.clientRow(id)
+	if row != nil && row.Visible() && !row.Discovered {
+		return
+	}
+	if row == nil {
+		row = newClientRow(id)
+		m.Client.Content.(*fyne.Container).Add(row)
+	}
+
+	row.Discovered = true
+	row.Status.SetText("discovered at " + addr.IP.String() + ", not connected")
+	row.Check.SetChecked(false)
+	row.Check.Disable()
+	row.Show()
+	m.Client.Refresh()
+}
+
+// expireDiscovered hides the discovered agents that stopped searching.
+func (m *mainAppData) expireDiscovered() {
+	discoveredMu.Lock()
+	defer discoveredMu.Unlock()
+
+	for id, seen := range discovered {
+		if time.Since(seen) >= discoveredTimeout {
+			delete(discovered, id)
+		}
+	}
+	for _, row := range m.clientRows() {
+		if _, ok := discovered[row.Check.Text]; row.Discovered && !ok {
+			row.Hide()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package discovery finds the downloader on the local network. An agent
+// started without the address of the downloader broadcasts a search over UDP
+// and the downloader answers with the port it listens on.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Port is the UDP port the downloader answers searches on.
+const Port = 8002
+
+// SearchInterval is the time between two searches of an agent.
+const SearchInterval = time.Second
+
+const (
+	service = "download_accelerator"
+
+	typeSearch = "search"
+	typeOffer  = "offer"
+)
+
+type message struct {
+	Service     string `json:"service"`
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	Version     int    `json:"version,omitempty"`
+	Port        string `json:"port,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Offer is the answer of a downloader. Fingerprint is empty when it does not
+// use TLS.
+type Offer struct {
+	IP          string
+	Port        string
+	Fingerprint string
+}
+
+// Search broadcasts a search for the agent id until a downloader of the same
+// protocol version answers or ctx is done. Anyone on the network can answer,
+// so the offer is only a hint of where the downloader is.
+func Search(ctx context.Context, id string, version int) (Offer, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return Offer{}, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	search, _ := json.Marshal(message{Service: service, Type: typeSearch, ID: id, Version: version})
+	buf := make([]byte, 2048)
+	for {
+		for _, addr := range broadcastAddrs() {
+			_, _ = conn.WriteToUDP(search, addr)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(SearchInterval))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if ctx.Err() != nil {
+				return Offer{}, ctx.Err()
+			}
+			if err != nil {
+				break
+			}
+
+			var msg message
+			if json.Unmarshal(buf[:n], &msg) != nil || msg.Service != service || msg.Type != typeOffer || msg.Version != version {
+				continue
+			}
+			return Offer{IP: from.IP.String(), Port: msg.Port, Fingerprint: msg.Fingerprint}, nil
+		}
+	}
+}
+
+// Respond answers the searches of agents with offer until ctx is done. seen is
+// called for every search, so the downloader can list the agents that are not
+// connected yet.
+func Respond(ctx context.Context, offer Offer, version int, seen func(id string, addr *net.UDPAddr)) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: Port})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	reply, _ := json.Marshal(message{Service: service, Type: typeOffer, Version: version, Port: offer.Port, Fingerprint: offer.Fingerprint})
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		var msg message
+		if json.Unmarshal(buf[:n], &msg) != nil || msg.Service != service || msg.Type != typeSearch {
+			continue
+		}
+		seen(msg.ID, from)
+		_, _ = conn.WriteToUDP(reply, from)
+	}
+}
+
+// broadcastAddrs returns the limited broadcast address and the broadcast
+// address of every IPv4 network the host is on, since the former only leaves
+// through the default interface.
+func broadcastAddrs() []*net.UDPAddr {
+	addrs := []*net.UDPAddr{{IP: net.IPv4bcast, Port: Port}}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip := make(net.IP, net.IPv4len)
+			for i := range ip {
+				ip[i] = ipNet.IP.To4()[i] | ^ipNet.Mask[len(ipNet.Mask)-net.IPv4len+i]
+			}
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: Port})
+		}
+	}
+	return addrs
+}
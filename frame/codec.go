@@ -0,0 +1,166 @@
+package frame
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone uint8 = iota
+	CodecGzip
+	CodecZstd
+)
+
+// Codec compresses the payload of data frames. Implementations are safe for
+// concurrent use.
+type Codec interface {
+	Encode(src []byte) []byte
+	// Decode returns an error rather than more than MaxPayload bytes.
+	Decode(src []byte) ([]byte, error)
+}
+
+var codecs = []struct {
+	name  string
+	codec Codec
+}{
+	CodecNone: {"none", noneCodec{}},
+	CodecGzip: {"gzip", gzipCodec{}},
+	CodecZstd: {"zstd", &zstdCodec{}},
+}
+
+// Preferred lists the names of the codecs from the most to the least
+// preferred, as offered in the handshake.
+var Preferred = []string{"zstd", "gzip", "none"}
+
+// CodecName returns the name of codec used in the handshake.
+func CodecName(codec uint8) string {
+	if int(codec) < len(codecs) {
+		return codecs[codec].name
+	}
+	return fmt.Sprintf("codec(%d)", codec)
+}
+
+// ParseCodec returns the codec called name.
+func ParseCodec(name string) (uint8, bool) {
+	for codec, c := range codecs {
+		if c.name == name {
+			return uint8(codec), true
+		}
+	}
+	return 0, false
+}
+
+// Lookup returns the implementation of codec, nil if it is unknown.
+func Lookup(codec uint8) Codec {
+	if int(codec) < len(codecs) {
+		return codecs[codec].codec
+	}
+	return nil
+}
+
+// DigestSize is the size of the SHA-256 digest at the start of the payload of
+// a data frame.
+const DigestSize = sha256.Size
+
+// ErrChecksum means the data of a frame does not match its digest.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Seal returns the payload of a data frame: the SHA-256 of data, as the agent
+// received it from the origin, followed by encoded, data encoded with the
+// codec of the frame.
+func Seal(data, encoded []byte) []byte {
+	sum := sha256.Sum256(data)
+	return append(sum[:], encoded...)
+}
+
+// Open decodes the payload of a data frame made by Seal and checks the data
+// against its digest.
+func Open(codec uint8, payload []byte) ([]byte, error) {
+	if len(payload) < DigestSize {
+		return nil, ErrChecksum
+	}
+	data, err := Decode(codec, payload[DigestSize:])
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], payload[:DigestSize]) {
+		return nil, ErrChecksum
+	}
+	return data, nil
+}
+
+// Decode decodes a payload encoded with codec.
+func Decode(codec uint8, src []byte) ([]byte, error) {
+	c := Lookup(codec)
+	if c == nil {
+		return nil, fmt.Errorf("unknown codec: %d", codec)
+	}
+	return c.Decode(src)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encode(src []byte) []byte {
+	return append([]byte(nil), src...)
+}
+
+func (noneCodec) Decode(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(src []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(src)
+	_ = gz.Close()
+	return buf.Bytes()
+}
+
+func (gzipCodec) Decode(src []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(gz, MaxPayload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxPayload {
+		return nil, ErrPayloadTooLarge
+	}
+	return data, nil
+}
+
+// zstdCodec shares one encoder and one decoder, whose EncodeAll and DecodeAll
+// may be called concurrently.
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (z *zstdCodec) init() {
+	z.once.Do(func() {
+		z.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		z.decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxPayload))
+	})
+}
+
+func (z *zstdCodec) Encode(src []byte) []byte {
+	z.init()
+	return z.encoder.EncodeAll(src, nil)
+}
+
+func (z *zstdCodec) Decode(src []byte) ([]byte, error) {
+	z.init()
+	return z.decoder.DecodeAll(src, nil)
+}
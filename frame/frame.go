@@ -0,0 +1,106 @@
+// Package frame implements the length-prefixed binary format shared by the
+// downloader and its agents. Every message on the wire is a fixed-size header
+// followed by Length bytes of payload, so part data travels as raw bytes
+// instead of being base64-encoded inside JSON.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type Command uint8
+
+const (
+	// Control frames carry a JSON-encoded networkResponse.
+	Control Command = iota + 1
+	// Data frames carry part bytes starting at Offset of file File, encoded
+	// with Codec and prefixed with their digest (see Seal).
+	Data
+	// Ack frames have no payload. The downloader sends one for every data
+	// frame it stored, with the Job, File, Part and Offset of that frame.
+	Ack
+)
+
+// HeaderSize is the encoded size of Header in bytes.
+const HeaderSize = 24
+
+// MaxPayload bounds the payload of a single frame so a corrupted header
+// cannot make the reader allocate an arbitrary amount of memory.
+const MaxPayload = 64 << 20
+
+var ErrPayloadTooLarge = errors.New("frame payload too large")
+
+type Header struct {
+	Command Command
+	Codec   uint8
+	File    uint16
+	Job     uint32
+	Part    uint32
+	Offset  int64
+	Length  uint32
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("cmd=%d job=%d file=%d part=%d offset=%d length=%d", h.Command, h.Job, h.File, h.Part, h.Offset, h.Length)
+}
+
+func (h Header) encode(b []byte) {
+	b[0] = byte(h.Command)
+	b[1] = h.Codec
+	binary.BigEndian.PutUint16(b[2:4], h.File)
+	binary.BigEndian.PutUint32(b[4:8], h.Job)
+	binary.BigEndian.PutUint32(b[8:12], h.Part)
+	binary.BigEndian.PutUint64(b[12:20], uint64(h.Offset))
+	binary.BigEndian.PutUint32(b[20:24], h.Length)
+}
+
+func decode(b []byte) Header {
+	return Header{
+		Command: Command(b[0]),
+		Codec:   b[1],
+		File:    binary.BigEndian.Uint16(b[2:4]),
+		Job:     binary.BigEndian.Uint32(b[4:8]),
+		Part:    binary.BigEndian.Uint32(b[8:12]),
+		Offset:  int64(binary.BigEndian.Uint64(b[12:20])),
+		Length:  binary.BigEndian.Uint32(b[20:24]),
+	}
+}
+
+// Write sends h and payload with a single call to w. h.Length is set from
+// len(payload). A connection written from several goroutines goes through a
+// Writer instead.
+func Write(w io.Writer, h Header, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return ErrPayloadTooLarge
+	}
+	h.Length = uint32(len(payload))
+
+	buf := make([]byte, HeaderSize+len(payload))
+	h.encode(buf)
+	copy(buf[HeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read reads the next frame from r.
+func Read(r io.Reader) (Header, []byte, error) {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Header{}, nil, err
+	}
+
+	h := decode(b[:])
+	if h.Length > MaxPayload {
+		return Header{}, nil, ErrPayloadTooLarge
+	}
+
+	payload := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Header{}, nil, err
+	}
+	return h, payload, nil
+}
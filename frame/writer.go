@@ -0,0 +1,88 @@
+package frame
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrWriterClosed is returned by Writer.Write once the writer is closed.
+var ErrWriterClosed = errors.New("frame writer closed")
+
+type pending struct {
+	h       Header
+	payload []byte
+	done    chan error
+}
+
+// Writer owns the write side of a connection, so frames written from many
+// goroutines reach it one at a time. It has two lanes: control and ack frames
+// are always written before the data frames waiting on the bulk lane, so
+// keep-alives and progress never wait for more than the frame being written.
+type Writer struct {
+	w       io.Writer
+	control chan pending
+	bulk    chan pending
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewWriter starts the goroutine that writes the frames of w until Close.
+func NewWriter(w io.Writer) *Writer {
+	fw := &Writer{
+		w:       w,
+		control: make(chan pending),
+		bulk:    make(chan pending),
+		closed:  make(chan struct{}),
+	}
+	go fw.run()
+	return fw
+}
+
+func (fw *Writer) run() {
+	var err error
+	for {
+		var p pending
+		select {
+		case p = <-fw.control:
+		case <-fw.closed:
+			return
+		default:
+			select {
+			case p = <-fw.control:
+			case p = <-fw.bulk:
+			case <-fw.closed:
+				return
+			}
+		}
+
+		// After a failed write the stream is broken, so the frames that
+		// follow are failed without being written.
+		if err == nil {
+			err = Write(fw.w, p.h, p.payload)
+		}
+		p.done <- err
+	}
+}
+
+// Write queues a frame on the lane of h.Command and waits until it is
+// written, so payload may be reused once it returns.
+func (fw *Writer) Write(h Header, payload []byte) error {
+	lane := fw.control
+	if h.Command == Data {
+		lane = fw.bulk
+	}
+
+	p := pending{h: h, payload: payload, done: make(chan error, 1)}
+	select {
+	case lane <- p:
+	case <-fw.closed:
+		return ErrWriterClosed
+	}
+	return <-p.done
+}
+
+// Close stops the writer. It does not close the underlying connection.
+func (fw *Writer) Close() {
+	fw.once.Do(func() { close(fw.closed) })
+}
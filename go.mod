@@ -6,6 +6,8 @@ require (
 	fyne.io/fyne/v2 v2.3.1
 	github.com/dustin/go-humanize v1.0.1
 	github.com/kkdai/youtube/v2 v2.7.18
+	github.com/klauspost/compress v1.16.7
+	golang.org/x/net v0.8.0
 )
 
 require (
@@ -37,7 +39,6 @@ require (
 	github.com/yuin/goldmark v1.5.4 // indirect
 	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
-	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
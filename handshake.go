@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/yms2772/download_accelerator/frame"
+	"github.com/yms2772/download_accelerator/identity"
+
+	"github.com/dustin/go-humanize"
+)
+
+// negotiate answers the hello of an agent. The agent is refused when it
+// speaks another protocol version or offers no codec the downloader can
+// decode; otherwise the first codec of its list that frame knows is chosen.
+// The agent may still send any frame without compression. The returned status
+// describes the outcome in the client list.
+func negotiate(h helloResponse) (helloResponse, string) {
+	if h.Version != protocolVersion {
+		reason := fmt.Sprintf("protocol version %d, expected %d", h.Version, protocolVersion)
+		if h.Version < protocolVersion {
+			reason += ": update the agent"
+		} else {
+			reason += ": update the downloader"
+		}
+		return helloResponse{Version: protocolVersion, Reason: reason}, reason
+	}
+
+	for _, name := range h.Codecs {
+		if _, ok := frame.ParseCodec(name); !ok {
+			continue
+		}
+
+		status := h.Build + ", " + name
+		if h.MaxConnections > 0 {
+			status += fmt.Sprintf(", max %d connections", h.MaxConnections)
+		}
+		if h.MemoryBudget > 0 {
+			status += ", " + humanize.Bytes(uint64(h.MemoryBudget)) + " memory"
+		}
+		return helloResponse{Version: protocolVersion, Accepted: true, Codec: name}, status
+	}
+
+	reason := fmt.Sprintf("no common codec in %v", h.Codecs)
+	return helloResponse{Version: protocolVersion, Reason: reason}, reason
+}
+
+// maxPairingFailures is the number of wrong pairing proofs after which pairing
+// is locked until the code is renewed, so the code cannot be guessed by trying
+// every one.
+const maxPairingFailures = 5
+
+// authenticate checks the answer of the agent id to the challenge nonce. The
+// agent must sign the nonce with the key of its hello. A paired key must keep
+// the ID it was paired with; a new key is paired when the agent also proves
+// the knowledge of the pairing code, which is then renewed.
+func (m *mainAppData) authenticate(h helloResponse, id string, nonce []byte, answer challengeResponse) error {
+	pub := ed25519.PublicKey(h.PublicKey)
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, nonce, answer.Signature) {
+		return errors.New("invalid signature")
+	}
+	if paired, ok := m.Paired.Lookup(pub); ok {
+		if paired != id {
+			return fmt.Errorf("the key is paired as %s", paired)
+		}
+		return nil
+	}
+
+	m.pairingMu.Lock()
+	defer m.pairingMu.Unlock()
+
+	if len(answer.Pairing) == 0 {
+		return errors.New("not paired: set DOWNLOAD_ACCELERATOR_PAIRING_CODE to the pairing code")
+	}
+	if m.pairingFailures >= maxPairingFailures {
+		return errors.New("pairing is locked after too many wrong codes: renew the pairing code")
+	}
+	if !identity.CheckPairing(m.pairingCode, nonce, pub, answer.Pairing) {
+		m.pairingFailures++
+		if m.pairingFailures >= maxPairingFailures {
+			m.PairingLabel.SetText("locked")
+		}
+		return errors.New("wrong pairing code")
+	}
+	if err := m.Paired.Add(pub, id); err != nil {
+		return err
+	}
+	m.renewPairingCode()
+	return nil
+}
+
+// renewPairingCode replaces the pairing code, so each code pairs one agent,
+// and unlocks pairing. Must be called with pairingMu held.
+func (m *mainAppData) renewPairingCode() {
+	m.pairingCode = identity.NewPairingCode()
+	m.pairingFailures = 0
+	m.PairingLabel.SetText(m.pairingCode)
+}
+
+// limit adapts the connections and settings of a download request to the
+// limits the client id announced in its hello. Every connection of an agent
+// buffers up to a chunk, so the memory budget shrinks the chunk size first and
+// the connections only when chunks cannot get any smaller.
+func limit(id string, connection int, settings settingsResponse) (int, settingsResponse) {
+	conn, ok := findConnection(id)
+	if !ok {
+		return connection, settings
+	}
+
+	h := conn.Hello
+	if h.MaxConnections > 0 && connection > h.MaxConnections {
+		connection = h.MaxConnections
+	}
+	if connection < 1 {
+		connection = 1
+	}
+
+	if h.MemoryBudget > 0 {
+		split := &settings.SplitTransferSetting
+		perConnection := int(h.MemoryBudget / int64(connection) / 1000 / 1000)
+		if split.ChunkSize <= 0 || split.ChunkSize > perConnection {
+			split.ChunkSize = perConnection
+		}
+		if split.ChunkSize < 1 {
+			split.ChunkSize = 1
+			connection = int(h.MemoryBudget / 1000 / 1000)
+			if connection < 1 {
+				connection = 1
+			}
+		}
+	}
+	return connection, settings
+}
@@ -0,0 +1,218 @@
+// Package header reads the request headers a download needs, like a
+// Referer, a bearer token or the cookies of a login, from what the user typed
+// or from the cookies.txt and .netrc files other tools export.
+package header
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secrets are the headers whose values are masked in logs.
+var secrets = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// reserved are the headers the agents set themselves. Accept-Encoding is
+// among them because a compressed response would not match the byte ranges
+// of the file.
+var reserved = map[string]bool{
+	"Accept-Encoding":     true,
+	"Connection":          true,
+	"Content-Length":      true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Range":               true,
+}
+
+// Parse reads one "Name: value" header per line. Blank lines are skipped.
+func Parse(text string) (http.Header, error) {
+	h := make(http.Header)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || len(name) == 0 || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: expected \"Name: value\"", i+1)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reserved[name] {
+			return nil, fmt.Errorf("line %d: %s is set by the agents", i+1, name)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// Format writes h as Parse reads it, sorted by name.
+func Format(h http.Header) string {
+	var b strings.Builder
+	for _, name := range Names(h) {
+		for _, value := range h[name] {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	return b.String()
+}
+
+// Names returns the sorted names of h.
+func Names(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Mask returns a copy of h fit for logs: the credentials of Authorization,
+// Proxy-Authorization and Cookie are replaced, keeping only the scheme.
+func Mask(h http.Header) http.Header {
+	masked := h.Clone()
+	for name, values := range masked {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if !secrets[name] {
+			continue
+		}
+		for i, value := range values {
+			if scheme, _, ok := strings.Cut(value, " "); ok && name != "Cookie" {
+				values[i] = scheme + " ***"
+			} else {
+				values[i] = "***"
+			}
+		}
+	}
+	return masked
+}
+
+// Cookies reads a cookies.txt file in the Netscape format exported by
+// browsers and curl, and returns the Cookie header to send to u: the cookies
+// that match its host, path and scheme and have not expired.
+func Cookies(r io.Reader, u *url.URL) (string, error) {
+	host := strings.ToLower(u.Hostname())
+	var cookies []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		// curl marks HttpOnly cookies with a prefix on an otherwise
+		// commented out line
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return "", fmt.Errorf("line %d: expected 7 fields separated by tabs, got %d", n, len(fields))
+		}
+		domain, subdomains, path, secure, name, value := strings.ToLower(fields[0]), fields[1] == "TRUE", fields[2], fields[3] == "TRUE", fields[5], fields[6]
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+
+		domain = strings.TrimPrefix(domain, ".")
+		switch {
+		case host != domain && !(subdomains && strings.HasSuffix(host, "."+domain)):
+		case !strings.HasPrefix(u.EscapedPath(), path) && !(path == "/" && len(u.Path) == 0):
+		case secure && u.Scheme != "https":
+		case expires != 0 && time.Unix(expires, 0).Before(time.Now()):
+		default:
+			cookies = append(cookies, name+"="+value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(cookies, "; "), nil
+}
+
+// Netrc reads a .netrc file and returns the login and password of host, or
+// of the default entry when host has none. ok is false when neither exists.
+func Netrc(r io.Reader, host string) (login, password string, ok bool, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	type entry struct{ login, password string }
+	var (
+		machines = make(map[string]*entry)
+		fallback *entry
+		current  *entry
+	)
+	// a macro runs until the next empty line and is skipped with its name
+	var tokens []string
+	macro := false
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if macro {
+			macro = len(fields) != 0
+			continue
+		}
+		for j, field := range fields {
+			if field == "macdef" {
+				fields, macro = fields[:j], true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	for i := 0; i < len(tokens); i++ {
+		value := ""
+		if i+1 < len(tokens) {
+			value = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &entry{}
+			machines[strings.ToLower(value)] = current
+			i++
+		case "default":
+			current = &entry{}
+			fallback = current
+		case "login":
+			if current != nil {
+				current.login = value
+			}
+			i++
+		case "password":
+			if current != nil {
+				current.password = value
+			}
+			i++
+		case "account", "port":
+			i++
+		}
+	}
+
+	e, found := machines[strings.ToLower(host)]
+	if !found {
+		e = fallback
+	}
+	if e == nil {
+		return "", "", false, nil
+	}
+	return e.login, e.password, true, nil
+}
+
+// BasicAuth returns the Authorization header of HTTP basic authentication.
+func BasicAuth(login, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(login+":"+password))
+}
@@ -0,0 +1,102 @@
+// Package identity gives every agent a persistent key pair. The downloader
+// pairs an agent once with a one-time code and from then on only accepts it
+// when it signs a fresh challenge with the paired key.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyFile is the default name of the file holding the key of an agent.
+const KeyFile = "agent.key"
+
+// NonceSize is the length of a challenge in bytes.
+const NonceSize = 32
+
+var ErrInvalidKey = errors.New("invalid agent key")
+
+// LoadOrCreate loads the private key stored at path, generating and saving a
+// new one the first time.
+func LoadOrCreate(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, ErrInvalidKey
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(ed25519.PrivateKey); ok {
+			return key, nil
+		}
+		return nil, ErrInvalidKey
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ID derives a short agent ID from pub, used when the agent is not given one.
+func ID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "daa_" + hex.EncodeToString(sum[:6])
+}
+
+func NewNonce() []byte {
+	nonce := make([]byte, NonceSize)
+	_, _ = rand.Read(nonce)
+	return nonce
+}
+
+// NewPairingCode returns a random code of 8 digits such as "0123-4567".
+func NewPairingCode() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(100000000))
+	code := fmt.Sprintf("%08d", n.Int64())
+	return code[:4] + "-" + code[4:]
+}
+
+// PairingProof proves the knowledge of code for the challenge nonce without
+// revealing it, and binds it to the key pub being paired. Dashes, spaces and
+// letter case in code are ignored.
+func PairingProof(code string, nonce []byte, pub ed25519.PublicKey) []byte {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write(nonce)
+	mac.Write(pub)
+	return mac.Sum(nil)
+}
+
+// CheckPairing reports whether proof was made by PairingProof with code.
+func CheckPairing(code string, nonce []byte, pub ed25519.PublicKey, proof []byte) bool {
+	return hmac.Equal(PairingProof(code, nonce, pub), proof)
+}
@@ -0,0 +1,70 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrIDTaken = errors.New("the ID is paired with another key")
+
+// Store is the list of paired agents of the downloader, saved as JSON. Each
+// key is bound to the agent ID it was paired with.
+type Store struct {
+	path string
+
+	mu     sync.Mutex
+	agents map[string]string
+}
+
+// OpenStore loads the store saved at path. A missing file is an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, agents: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.agents); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Lookup returns the ID pub was paired with.
+func (s *Store) Lookup(pub ed25519.PublicKey) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.agents[base64.StdEncoding.EncodeToString(pub)]
+	return id, ok
+}
+
+// Add pairs pub with id and saves the store.
+func (s *Store) Add(pub ed25519.PublicKey, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := base64.StdEncoding.EncodeToString(pub)
+	for k, v := range s.agents {
+		if v == id && k != key {
+			return ErrIDTaken
+		}
+	}
+	s.agents[key] = id
+
+	data, err := json.MarshalIndent(s.agents, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o600)
+}
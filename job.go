@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yms2772/download_accelerator/checksum"
+	"github.com/yms2772/download_accelerator/output"
+	"github.com/yms2772/download_accelerator/scheduler"
+)
+
+// partsPerClient is the average number of parts each client downloads when
+// the job uses the dynamic scheduler.
+const partsPerClient = 4
+
+// maxPartFailures is the number of parts that may fail after exhausting their
+// retries before the job is given up.
+const maxPartFailures = 10
+
+type jobData struct {
+	sync.Mutex
+	ID           uint32
+	Files        []downloadResponse
+	Output       []*output.File
+	Scheduler    scheduler.Scheduler
+	Agents       []string
+	Connection   int
+	Settings     settingsResponse
+	Failures     int
+	SingleStream bool
+	Finished     bool
+	Checksum     string
+}
+
+// newJobID returns a random job ID other than zero and previous. Agents keep
+// the work of a job across a restart of the downloader and send it when they
+// reconnect, so an ID must not come back in the next run.
+func newJobID(previous uint32) uint32 {
+	var b [4]byte
+	for {
+		_, _ = rand.Read(b[:])
+		if id := binary.BigEndian.Uint32(b[:]); id != 0 && id != previous {
+			return id
+		}
+	}
+}
+
+// newJob opens an output file in dir for every file of the job, resuming the
+// data left by a previous attempt when its manifest still matches.
+func newJob(id uint32, dir string, files []downloadResponse) (*jobData, error) {
+	job := &jobData{
+		ID:     id,
+		Files:  make([]downloadResponse, len(files)),
+		Output: make([]*output.File, len(files)),
+	}
+	copy(job.Files, files)
+	for i, file := range files {
+		f, err := output.Open(dir+"/"+file.Filename, output.Manifest{
+			URL:          file.URL,
+			ETag:         file.ETag,
+			LastModified: file.LastModified,
+			Length:       file.ContentLength,
+		})
+		if err != nil {
+			job.close()
+			return nil, err
+		}
+		job.Output[i] = f
+	}
+	return job, nil
+}
+
+// missing returns every range of the job that is not on disk yet.
+func (j *jobData) missing() []scheduler.Range {
+	var ranges []scheduler.Range
+	for i, f := range j.Output {
+		for _, r := range f.Missing() {
+			ranges = append(ranges, scheduler.Range{File: i, Start: r.Start, Last: r.Last})
+		}
+	}
+	return ranges
+}
+
+// missingIn returns the parts of r that are not on disk yet. A Last of -1 on
+// either side means the range runs to the end of the file.
+func (j *jobData) missingIn(r scheduler.Range) []scheduler.Range {
+	var ranges []scheduler.Range
+	for _, m := range j.Output[r.File].Missing() {
+		if m.Start < r.Start {
+			m.Start = r.Start
+		}
+		if r.Last >= 0 && (m.Last < 0 || m.Last > r.Last) {
+			m.Last = r.Last
+		}
+		if m.Last < 0 || m.Start <= m.Last {
+			ranges = append(ranges, scheduler.Range{File: r.File, Start: m.Start, Last: m.Last})
+		}
+	}
+	return ranges
+}
+
+// next builds the download request for the ranges the scheduler hands to the
+// client id. It reports false when there is nothing left for the client.
+func (j *jobData) next(id string) (networkResponse, bool) {
+	ranges := j.Scheduler.Next(id)
+	if len(ranges) == 0 {
+		return networkResponse{}, false
+	}
+
+	connection, settings := limit(id, j.Connection, j.Settings)
+	resp := networkResponse{
+		ID:       id,
+		Job:      j.ID,
+		Command:  download,
+		Settings: settings,
+	}
+	for _, r := range ranges {
+		file := j.Files[r.File]
+		file.File = r.File
+		file.Connection = connection
+		file.StartIndex = r.Start
+		file.LastIndex = r.Last
+		resp.Download = append(resp.Download, file)
+	}
+	return resp, true
+}
+
+// receive writes data at offset of the file.
+func (j *jobData) receive(file int, offset int64, data []byte) error {
+	if file >= len(j.Output) {
+		return output.ErrOutOfRange
+	}
+	_, err := j.Output[file].WriteAt(data, offset)
+	return err
+}
+
+// finish reports whether every range of the job is on disk. It returns true
+// only once, so the job is completed by a single caller.
+func (j *jobData) finish() bool {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.Finished || !j.Scheduler.Done() {
+		return false
+	}
+	j.Finished = true
+	return true
+}
+
+// singleStream switches the job to a single connection of one client fetching
+// the missing data of every file as a stream, for origins that ignore the
+// Range header or do not tell the length of the file. It reports false if the
+// job already uses a single stream.
+func (j *jobData) singleStream() bool {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.SingleStream {
+		return false
+	}
+	j.SingleStream = true
+
+	for i := range j.Files {
+		j.Files[i].Stream = true
+	}
+	j.Connection = 1
+	j.Scheduler = scheduler.NewSingle(j.missing(), j.missingIn)
+	return true
+}
+
+// uploaded records the files a client finished. A file of unknown length is
+// complete once its stream has ended.
+func (j *jobData) uploaded(files []uploadResponse) {
+	for _, file := range files {
+		if file.File < len(j.Files) && j.Files[file.File].ContentLength < 0 {
+			_ = j.Output[file.File].SetSize(file.LastIndex + 1)
+		}
+	}
+}
+
+// fail counts a failed part and reports whether the job has to be given up.
+// It returns true only once.
+func (j *jobData) fail() bool {
+	j.Lock()
+	defer j.Unlock()
+
+	j.Failures++
+	if j.Finished || j.Failures < maxPartFailures {
+		return false
+	}
+	j.Finished = true
+	return true
+}
+
+// abort gives the job up at once. It returns true only once.
+func (j *jobData) abort() bool {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.Finished {
+		return false
+	}
+	j.Finished = true
+	return true
+}
+
+// commit moves every output file to its destination path.
+func (j *jobData) commit() error {
+	for _, f := range j.Output {
+		if err := f.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the file of a single file job saved in dir against the
+// checksum given by the user or, without one, the checksum published next to
+// its URL. It returns the result to show in the completion dialog, and false
+// when the file does not match.
+func (j *jobData) verify(dir string) (string, bool) {
+	file := j.Files[0]
+	source := "given"
+	want, err := checksum.Parse(j.Checksum)
+	if len(j.Checksum) == 0 {
+		var sumsURL string
+		want, sumsURL, err = checksum.Discover(&http.Client{Timeout: 10 * time.Second}, file.URL)
+		if errors.Is(err, checksum.ErrNotFound) {
+			return "Checksum: not checked, none found next to the URL", true
+		}
+		source = "from " + sumsURL
+	}
+	if err != nil {
+		return "Checksum: not checked, " + err.Error(), true
+	}
+
+	got, err := want.File(dir + "/" + file.Filename)
+	if err != nil {
+		return "Checksum: cannot read the file, " + err.Error(), false
+	}
+	if !got.Equal(want) {
+		return fmt.Sprintf("Checksum mismatch (%s)\nExpected: %s\nGot: %s", source, want, got), false
+	}
+	return fmt.Sprintf("Checksum: %s passed (%s)", want.Algorithm, source), true
+}
+
+// close keeps the partial files and their manifests so the job can be
+// resumed.
+func (j *jobData) close() {
+	for _, f := range j.Output {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,8 +14,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -20,12 +25,20 @@ import (
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/dustin/go-humanize"
 	"github.com/kkdai/youtube/v2"
 	"github.com/yms2772/download_accelerator/agent"
+	"github.com/yms2772/download_accelerator/checksum"
+	"github.com/yms2772/download_accelerator/discovery"
+	"github.com/yms2772/download_accelerator/header"
+	"github.com/yms2772/download_accelerator/identity"
+	"github.com/yms2772/download_accelerator/relay"
+	"github.com/yms2772/download_accelerator/scheduler"
+	"github.com/yms2772/download_accelerator/transport"
 )
 
 type mainAppData struct {
@@ -35,38 +48,108 @@ type mainAppData struct {
 	LogWindow  fyne.Window
 	Client     *container.Scroll
 	Log        map[string]*container.Scroll
+	LogSelect  *widget.Select
 	Processing *dialog.ProgressInfiniteDialog
 	SelfClient *agent.Data
 	Connected  bool
+	// Fingerprint of the TLS certificate, empty when TLS is disabled.
+	Fingerprint  string
+	TLSConfig    *tls.Config
+	Paired       *identity.Store
+	PairingLabel *widget.Label
+	pairingMu    sync.Mutex
+	pairingCode  string
+	// pairingFailures counts the wrong pairing proofs since the code was
+	// renewed.
+	pairingFailures int
+	// AgentBuffer is the window in bytes advertised to every agent.
+	AgentBuffer int64
 }
 
 func (m *mainAppData) refreshClient() {
+	m.expireDiscovered()
+	job := currentJob
+	dropped := make(map[string]*connectionData)
+	connectionsMu.Lock()
 	for id, conn := range connections {
 		if time.Now().Sub(conn.LastConnection).Seconds() >= 1 {
 			delete(connections, id)
-			for _, object := range m.Client.Content.(*fyne.Container).Objects {
-				switch object.(type) {
-				case *widget.Check:
-					if object.(*widget.Check).Text == id {
-						object.Hide()
-					}
-				}
-			}
+			dropped[id] = conn
+		}
+	}
+	connectionsMu.Unlock()
+
+	for id, conn := range dropped {
+		if row := m.clientRow(id); row != nil {
+			row.Hide()
+		}
+
+		if job != nil && !job.Finished {
+			lostMu.Lock()
+			lost[id] = lostClient{Session: conn.Hello.Session, Since: time.Now()}
+			lostMu.Unlock()
+			m.logEvent(id, "Connection lost, waiting for it to resume")
 		}
 	}
+
+	lostMu.Lock()
+	defer lostMu.Unlock()
+	for id, client := range lost {
+		if time.Since(client.Since) < resumeTimeout {
+			continue
+		}
+		delete(lost, id)
+		if job != nil && !job.Finished {
+			go m.reassign(job, id)
+		}
+	}
+}
+
+// addLog creates the log of the client id with a card per connection.
+func (m *mainAppData) addLog(id string, parallel int) {
+	m.Log[id] = container.NewVScroll(container.NewVBox())
+	m.LogSelect.Options = append(m.LogSelect.Options, id)
+	for i := 0; i < parallel; i++ {
+		m.Log[id].Content.(*fyne.Container).Add(widget.NewCard("", "Preparing to download...", widget.NewProgressBar()))
+	}
+}
+
+// logEvent appends an event card to the log of the client id.
+func (m *mainAppData) logEvent(id, text string) {
+	log.Printf("%s: %s", id, text)
+	if m.Log[id] == nil {
+		return
+	}
+	m.Log[id].Content.(*fyne.Container).Add(widget.NewCard("", time.Now().Format("15:04:05 ")+text, nil))
 }
 
 func main() {
-	runMode := flag.String("mode", "downloader", "run mode: 'downloader', 'client' (default: 'downloader')")
+	runMode := flag.String("mode", "downloader", "run mode: 'downloader', 'client', 'relay' (default: 'downloader')")
+	listen := flag.String("listen", "", "client mode: address to wait on for the downloader to connect, e.g. ':8001'; relay mode: address to listen on (default: ':8003')")
 	flag.Parse()
 
 	switch *runMode {
 	case "downloader":
 	case "client":
+		opts := agent.OptionsFromEnv()
+		if len(*listen) != 0 {
+			opts.Listen = *listen
+		}
 		agentData := agent.New()
-		if err := agentData.RunAgent(); err != nil {
+		if err := agentData.RunAgent(opts); err != nil {
 			log.Fatal(err)
 		}
+	case "relay":
+		addr := *listen
+		if len(addr) == 0 {
+			addr = ":8003"
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Relay listening on %s", l.Addr())
+		log.Fatal(relay.NewServer().Serve(l))
 	default:
 		flag.PrintDefaults()
 		return
@@ -91,10 +174,9 @@ func main() {
 				return
 			}
 
-			for _, object := range mainApp.Client.Content.(*fyne.Container).Objects {
-				switch object.(type) {
-				case *widget.Check:
-					object.(*widget.Check).SetChecked(b)
+			for _, row := range mainApp.clientRows() {
+				if !row.Check.Disabled() {
+					row.Check.SetChecked(b)
 				}
 			}
 		}()
@@ -108,20 +190,24 @@ func main() {
 			}
 
 			if b {
+				key, err := identity.LoadOrCreate(filepath.Join(mainApp.App.Storage().RootURI().Path(), "self_client.key"))
+				if err == nil {
+					err = mainApp.Paired.Add(key.Public().(ed25519.PublicKey), "self_client")
+				}
+				if err != nil {
+					dialog.ShowError(errors.New("cannot load the self client key:\n"+err.Error()), mainApp.Window)
+					return
+				}
+
 				mainApp.SelfClient = agent.New()
 				mainApp.Processing.Show()
 
 				go func() {
 					for {
 						time.Sleep(time.Second)
-						if _, ok := connections["self_client"]; ok {
-							for _, object := range mainApp.Client.Content.(*fyne.Container).Objects {
-								switch object.(type) {
-								case *widget.Check:
-									if object.(*widget.Check).Text == "self_client" {
-										object.(*widget.Check).SetChecked(b)
-									}
-								}
+						if _, ok := findConnection("self_client"); ok {
+							if row := mainApp.clientRow("self_client"); row != nil {
+								row.Check.SetChecked(b)
 							}
 							mainApp.Processing.Hide()
 							return
@@ -130,9 +216,11 @@ func main() {
 				}()
 
 				if err := mainApp.SelfClient.RunAgent(agent.RunAgentOptions{
-					ID:   "self_client",
-					IP:   "127.0.0.1",
-					Port: mainApp.App.Preferences().StringWithFallback("data_transform_port", "8001"),
+					ID:          "self_client",
+					IP:          "127.0.0.1",
+					Port:        mainApp.App.Preferences().StringWithFallback("data_transform_port", "8001"),
+					Fingerprint: mainApp.Fingerprint,
+					Key:         key,
 				}); err != nil {
 					dialog.ShowError(errors.New("an error occurred:\n"+err.Error()), mainApp.Window)
 				}
@@ -146,10 +234,23 @@ func main() {
 		}()
 	})
 
+	addAgentBtn := widget.NewButtonWithIcon("", theme.ContentAddIcon(), func() {
+		addrInput := widget.NewEntry()
+		addrInput.SetPlaceHolder("host:port")
+		dialog.ShowForm("Add agent by address", "Connect", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Address", addrInput),
+		}, func(b bool) {
+			if b && len(addrInput.Text) != 0 {
+				go mainApp.dialAgent(addrInput.Text)
+			}
+		}, mainApp.Window)
+	})
+
 	allCheck.Disable()
 	selfCheck.Disable()
+	addAgentBtn.Disable()
 
-	mainApp.Client.Content.(*fyne.Container).Add(container.NewHBox(allCheck, selfCheck))
+	mainApp.Client.Content.(*fyne.Container).Add(container.NewHBox(allCheck, selfCheck, layout.NewSpacer(), addAgentBtn))
 
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
@@ -167,6 +268,7 @@ func main() {
 		logCard.SetContent(mainApp.Log[s])
 	})
 	logSelect.PlaceHolder = "Client ID"
+	mainApp.LogSelect = logSelect
 
 	logSelectPrev := widget.NewButtonWithIcon("", theme.NavigateBackIcon(), func() {
 		if logSelect.SelectedIndex() <= 0 {
@@ -191,6 +293,62 @@ func main() {
 	clientPortInput := widget.NewEntry()
 	clientPortInput.SetPlaceHolder("default: 8001")
 	clientPortInput.SetText(mainApp.App.Preferences().StringWithFallback("data_transform_port", "8001"))
+	clientPortInput.OnChanged = func(s string) {
+		mainApp.App.Preferences().SetString("data_transform_port", s)
+	}
+
+	agentBufferInput := widget.NewEntry()
+	agentBufferInput.SetText(mainApp.App.Preferences().StringWithFallback("agent_buffer", "32"))
+	agentBufferInput.Validator = func(s string) error {
+		if _, err := strconv.Atoi(s); err != nil {
+			return errors.New("must enter only numbers")
+		}
+		return nil
+	}
+	agentBufferInput.OnChanged = func(s string) {
+		mainApp.App.Preferences().SetString("agent_buffer", s)
+	}
+
+	webSocketPortInput := widget.NewEntry()
+	webSocketPortInput.SetPlaceHolder("8004 (optional)")
+	webSocketPortInput.SetText(mainApp.App.Preferences().String("websocket_port"))
+	webSocketPortInput.OnChanged = func(s string) {
+		mainApp.App.Preferences().SetString("websocket_port", s)
+	}
+
+	clientTLSCheck := widget.NewCheck("", func(b bool) {
+		mainApp.App.Preferences().SetBool("tls", b)
+	})
+	clientTLSCheck.SetChecked(mainApp.App.Preferences().Bool("tls"))
+
+	copyFingerprintBtn := widget.NewButtonWithIcon("Fingerprint", theme.ContentCopyIcon(), func() {
+		mainApp.Window.Clipboard().SetContent(mainApp.Fingerprint)
+	})
+	copyFingerprintBtn.Hide()
+
+	relayInput := widget.NewEntry()
+	relayInput.SetPlaceHolder("relay.example.com:8003 (optional)")
+	relayInput.SetText(mainApp.App.Preferences().String("relay_address"))
+	relayInput.OnChanged = func(s string) {
+		mainApp.App.Preferences().SetString("relay_address", s)
+	}
+
+	roomInput := widget.NewEntry()
+	if len(mainApp.App.Preferences().String("relay_room")) == 0 {
+		mainApp.App.Preferences().SetString("relay_room", relay.NewRoom())
+	}
+	roomInput.SetText(mainApp.App.Preferences().String("relay_room"))
+	roomInput.OnChanged = func(s string) {
+		mainApp.App.Preferences().SetString("relay_room", s)
+	}
+
+	mainApp.PairingLabel = widget.NewLabel("-")
+	renewPairingBtn := widget.NewButtonWithIcon("", theme.ViewRefreshIcon(), func() {
+		mainApp.pairingMu.Lock()
+		defer mainApp.pairingMu.Unlock()
+		mainApp.renewPairingCode()
+	})
+	renewPairingBtn.Disable()
 
 	clientConnectBtn := widget.NewButtonWithIcon("", theme.SearchIcon(), nil)
 	clientConnectBtn.OnTapped = func() {
@@ -200,12 +358,31 @@ func main() {
 
 			go func() {
 				clientConnectBtn.Disable()
+				clientPortInput.Disable()
+				webSocketPortInput.Disable()
+				agentBufferInput.Disable()
+				clientTLSCheck.Disable()
+				relayInput.Disable()
+				roomInput.Disable()
 				allCheck.Enable()
 				selfCheck.Enable()
+				addAgentBtn.Enable()
 				defer func() {
 					clientConnectBtn.Enable()
+					clientPortInput.Enable()
+					webSocketPortInput.Enable()
+					agentBufferInput.Enable()
+					clientTLSCheck.Enable()
+					relayInput.Enable()
+					roomInput.Enable()
 					allCheck.Disable()
 					selfCheck.Disable()
+					addAgentBtn.Disable()
+					copyFingerprintBtn.Hide()
+					renewPairingBtn.Disable()
+					mainApp.PairingLabel.SetText("-")
+					mainApp.Fingerprint = ""
+					mainApp.TLSConfig = nil
 					mainApp.Connected = false
 				}()
 
@@ -216,7 +393,72 @@ func main() {
 				}
 				defer l.Close()
 
+				paired, err := identity.OpenStore(filepath.Join(mainApp.App.Storage().RootURI().Path(), "paired.json"))
+				if err != nil {
+					dialog.ShowError(errors.New("cannot load the paired agents:\n"+err.Error()), mainApp.Window)
+					return
+				}
+				mainApp.Paired = paired
+				if mb, err := strconv.Atoi(agentBufferInput.Text); err == nil && mb > 0 {
+					mainApp.AgentBuffer = int64(mb) * 1000 * 1000
+				} else {
+					mainApp.AgentBuffer = 0
+				}
+				mainApp.pairingMu.Lock()
+				mainApp.renewPairingCode()
+				mainApp.pairingMu.Unlock()
+				renewPairingBtn.Enable()
+
+				if clientTLSCheck.Checked {
+					cert, err := transport.LoadOrCreateCertificate(mainApp.App.Storage().RootURI().Path())
+					if err != nil {
+						dialog.ShowError(errors.New("cannot load the certificate:\n"+err.Error()), mainApp.Window)
+						return
+					}
+					mainApp.Fingerprint = transport.Fingerprint(cert)
+					log.Printf("TLS fingerprint: %s", mainApp.Fingerprint)
+					mainApp.TLSConfig = transport.ServerConfig(cert)
+					l = tls.NewListener(l, mainApp.TLSConfig)
+					copyFingerprintBtn.Show()
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go func() {
+					offer := discovery.Offer{
+						Port:        mainApp.App.Preferences().StringWithFallback("data_transform_port", "8001"),
+						Fingerprint: mainApp.Fingerprint,
+					}
+					if err := discovery.Respond(ctx, offer, protocolVersion, mainApp.discover); err != nil {
+						log.Printf("LAN discovery is disabled: %s", err)
+					}
+				}()
+
+				if port := webSocketPortInput.Text; len(port) != 0 {
+					wl, err := transport.ListenWebSocket("0.0.0.0:" + port)
+					if err != nil {
+						dialog.ShowError(fmt.Errorf("cannot open websocket server on %s port", port), mainApp.Window)
+						return
+					}
+					defer wl.Close()
+					if mainApp.TLSConfig != nil {
+						wl = tls.NewListener(wl, mainApp.TLSConfig)
+					}
+					go func() {
+						for {
+							conn, err := wl.Accept()
+							if err != nil {
+								return
+							}
+							go mainApp.newConnection(conn)
+						}
+					}()
+				}
+
 				mainApp.Connected = true
+				if len(relayInput.Text) != 0 && len(roomInput.Text) != 0 {
+					go mainApp.serveRelay(relayInput.Text, roomInput.Text)
+				}
 
 				for {
 					conn, err := l.Accept()
@@ -231,7 +473,15 @@ func main() {
 		}()
 	}
 
-	clientConnectBox := container.NewBorder(nil, nil, nil, clientConnectBtn, widget.NewForm(widget.NewFormItem("Port", clientPortInput)), clientConnectBtn)
+	clientConnectBox := container.NewBorder(nil, nil, nil, clientConnectBtn, widget.NewForm(
+		widget.NewFormItem("Port", clientPortInput),
+		widget.NewFormItem("WebSocket", webSocketPortInput),
+		widget.NewFormItem("Buffer", container.NewGridWithColumns(2, agentBufferInput, widget.NewLabelWithStyle("MB", fyne.TextAlignLeading, fyne.TextStyle{}))),
+		widget.NewFormItem("TLS", container.NewBorder(nil, nil, nil, copyFingerprintBtn, clientTLSCheck, copyFingerprintBtn)),
+		widget.NewFormItem("Pairing", container.NewBorder(nil, nil, nil, renewPairingBtn, mainApp.PairingLabel, renewPairingBtn)),
+		widget.NewFormItem("Relay", relayInput),
+		widget.NewFormItem("Room", roomInput),
+	), clientConnectBtn)
 
 	filenameInput := widget.NewEntry()
 	filenameInput.Validator = func(s string) error {
@@ -244,6 +494,8 @@ func main() {
 	sizeLabel := widget.NewLabel("")
 
 	var downResp []downloadResponse
+	var singleStream bool
+	var requestHeader http.Header
 	urlInput := widget.NewEntry()
 	urlInput.SetPlaceHolder("https://example.com")
 	urlInput.Validator = func(s string) error {
@@ -425,6 +677,7 @@ func main() {
 				if !<-ytFormSubmit {
 					return
 				}
+				singleStream = false
 				if ytAudioIncluded.Checked {
 					audio, err := youtubeAudio(video.Formats)
 					if err != nil {
@@ -453,46 +706,36 @@ func main() {
 				downResp[0].Filename = "video." + strings.Split(extension, "/")[1]
 				downResp[0].ContentLength = video.Formats[qualitySelect.SelectedIndex()].ContentLength
 			default:
-				resp, err := http.Head(s)
-				if resp != nil {
-					defer resp.Body.Close()
-				}
+				file, ranges, err := probe(s, requestHeader)
 				if err != nil {
+					dialog.ShowError(fmt.Errorf("cannot get the file:\n%s", err), mainApp.Window)
 					return
 				}
-
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
-				if resp.ContentLength < 0 {
-					return
-				}
-				if resp.ContentLength > 0 && resp.ContentLength < 1000000 {
+				if file.ContentLength > 0 && file.ContentLength < 1000000 {
 					dialog.ShowError(errors.New("content size must be over 1mb"), mainApp.Window)
 					return
 				}
 
-				downResp = make([]downloadResponse, 1)
-				if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err != nil || len(params["filename"]) == 0 {
-					u, _ := url.Parse(urlInput.Text)
-					paths := strings.Split(u.Path, "/")
-					if len(paths) != 0 {
-						downResp[0].Filename = paths[len(paths)-1]
-					} else {
-						downResp[0].Filename = "unknown"
-					}
-				} else {
-					downResp[0].Filename = params["filename"]
-				}
-				downResp[0].URL = s
-				downResp[0].ContentLength = resp.ContentLength
+				downResp = []downloadResponse{file}
+				singleStream = !ranges || file.ContentLength < 0
 			}
 			var totalLength int64
 			for _, resp := range downResp {
+				if resp.ContentLength < 0 {
+					totalLength = -1
+					break
+				}
 				totalLength += resp.ContentLength
 			}
 			filenameInput.SetText(downResp[0].Filename)
-			sizeLabel.SetText("~ " + humanize.Bytes(uint64(totalLength)))
+			switch {
+			case totalLength < 0:
+				sizeLabel.SetText("unknown size, single stream")
+			case singleStream:
+				sizeLabel.SetText("~ " + humanize.Bytes(uint64(totalLength)) + ", single stream")
+			default:
+				sizeLabel.SetText("~ " + humanize.Bytes(uint64(totalLength)))
+			}
 		}()
 	}
 
@@ -523,6 +766,109 @@ func main() {
 		return nil
 	}
 
+	retryInput := widget.NewEntry()
+	retryInput.SetText("5")
+	retryInput.Validator = func(s string) error {
+		if _, err := strconv.Atoi(s); err != nil {
+			return errors.New("must enter only numbers")
+		}
+		return nil
+	}
+
+	checksumInput := widget.NewEntry()
+	checksumInput.SetPlaceHolder("sha256:... (optional, searched next to the URL)")
+	checksumInput.Validator = func(s string) error {
+		if len(strings.TrimSpace(s)) == 0 {
+			return nil
+		}
+		_, err := checksum.Parse(s)
+		return err
+	}
+
+	schedulerSelect := widget.NewSelect([]string{"Dynamic", "Static"}, nil)
+	schedulerSelect.SetSelected("Dynamic")
+
+	headersLabel := widget.NewLabel("None")
+	editHeaders := widget.NewButtonWithIcon("", theme.DocumentCreateIcon(), func() {
+		headersInput := widget.NewMultiLineEntry()
+		headersInput.SetPlaceHolder("User-Agent: ...\nReferer: ...\nAuthorization: Bearer ...\nCookie: ...")
+		headersInput.SetText(header.Format(requestHeader))
+		headersInput.Validator = func(s string) error {
+			_, err := header.Parse(s)
+			return err
+		}
+
+		// importHeader opens a file and sets the header returned by read for
+		// the host of the URL.
+		importHeader := func(name string, read func(r io.Reader, u *url.URL) (string, error)) {
+			u, err := url.Parse(urlInput.Text)
+			if err != nil || len(u.Host) == 0 {
+				dialog.ShowError(errors.New("enter the URL first"), mainApp.Window)
+				return
+			}
+			dialog.ShowFileOpen(func(f fyne.URIReadCloser, err error) {
+				if err != nil || f == nil {
+					return
+				}
+				defer f.Close()
+
+				h, err := header.Parse(headersInput.Text)
+				if err != nil {
+					dialog.ShowError(err, mainApp.Window)
+					return
+				}
+				value, err := read(f, u)
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("cannot import %s:\n%s", f.URI().Name(), err), mainApp.Window)
+					return
+				}
+				if len(value) == 0 {
+					dialog.ShowError(fmt.Errorf("%s has nothing for %s", f.URI().Name(), u.Hostname()), mainApp.Window)
+					return
+				}
+				h.Set(name, value)
+				headersInput.SetText(header.Format(h))
+			}, mainApp.Window)
+		}
+		importCookies := widget.NewButton("cookies.txt", func() {
+			importHeader("Cookie", header.Cookies)
+		})
+		importNetrc := widget.NewButton(".netrc", func() {
+			importHeader("Authorization", func(r io.Reader, u *url.URL) (string, error) {
+				login, password, ok, err := header.Netrc(r, u.Hostname())
+				if err != nil || !ok {
+					return "", err
+				}
+				return header.BasicAuth(login, password), nil
+			})
+		})
+
+		headersDlg := dialog.NewForm("Request headers", "Apply", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Headers", headersInput),
+			widget.NewFormItem("Import", container.NewHBox(importCookies, importNetrc)),
+		}, func(b bool) {
+			if !b {
+				return
+			}
+			h, err := header.Parse(headersInput.Text)
+			if err != nil {
+				dialog.ShowError(err, mainApp.Window)
+				return
+			}
+			requestHeader = h
+			headersLabel.SetText("None")
+			if len(h) != 0 {
+				headersLabel.SetText(strings.Join(header.Names(h), ", "))
+			}
+			// probe the URL again with the new headers
+			if len(urlInput.Text) != 0 {
+				urlInput.OnChanged(urlInput.Text)
+			}
+		}, mainApp.Window)
+		headersDlg.Resize(fyne.NewSize(500, 300))
+		headersDlg.Show()
+	})
+
 	pasteURL := widget.NewButtonWithIcon("", theme.ContentPasteIcon(), func() {
 		if mainApp.Window.Clipboard() == nil {
 			return
@@ -533,9 +879,13 @@ func main() {
 	settingForm := widget.NewForm(
 		widget.NewFormItem("URL", container.NewBorder(nil, nil, nil, pasteURL, urlInput, pasteURL)),
 		widget.NewFormItem("Filename", container.NewVBox(filenameInput, sizeLabel)),
+		widget.NewFormItem("Headers", container.NewBorder(nil, nil, nil, editHeaders, headersLabel, editHeaders)),
 		widget.NewFormItem("Parallel", parallelInput),
 		widget.NewFormItem("Chunk Size", container.NewGridWithColumns(2, chunkSizeInput, widget.NewLabelWithStyle("MB", fyne.TextAlignLeading, fyne.TextStyle{}))),
 		widget.NewFormItem("Chunk Parallel", chunkParallelInput),
+		widget.NewFormItem("Retry", retryInput),
+		widget.NewFormItem("Checksum", checksumInput),
+		widget.NewFormItem("Scheduler", schedulerSelect),
 	)
 	settingForm.SubmitText = "Download"
 	settingForm.OnSubmit = func() {
@@ -560,20 +910,17 @@ func main() {
 				chunkParallel = 5
 			}
 
+			retry, err := strconv.Atoi(retryInput.Text)
+			if err != nil {
+				retry = 5
+			}
+
 			var checked []string
 			logSelect.Options = []string{}
-			for _, object := range mainApp.Client.Content.(*fyne.Container).Objects {
-				switch object.(type) {
-				case *widget.Check:
-					check := object.(*widget.Check)
-					if check.Text != "All" && check.Visible() && check.Checked {
-						checked = append(checked, check.Text)
-						mainApp.Log[check.Text] = container.NewVScroll(container.NewVBox())
-						logSelect.Options = append(logSelect.Options, check.Text)
-						for i := 0; i < parallel; i++ {
-							mainApp.Log[check.Text].Content.(*fyne.Container).Add(widget.NewCard("", "Preparing to download...", widget.NewProgressBar()))
-						}
-					}
+			for _, row := range mainApp.clientRows() {
+				if row.Visible() && !row.Check.Disabled() && row.Check.Checked {
+					checked = append(checked, row.Check.Text)
+					mainApp.addLog(row.Check.Text, parallel)
 				}
 			}
 
@@ -582,6 +929,21 @@ func main() {
 				return
 			}
 
+			_ = os.Mkdir("downloaded", os.ModePerm)
+			var previous uint32
+			if currentJob != nil {
+				previous = currentJob.ID
+				cancelJob(currentJob)
+				currentJob.close()
+			}
+			job, err := newJob(newJobID(previous), "downloaded", downResp)
+			if err != nil {
+				dialog.ShowError(errors.New("cannot create the file:\n"+err.Error()), mainApp.Window)
+				return
+			}
+			currentJob = job
+			job.Checksum = strings.TrimSpace(checksumInput.Text)
+
 			mainApp.Processing.Show()
 			logCard.SetContent(mainApp.Log[checked[0]])
 			logSelect.SetSelectedIndex(0)
@@ -596,34 +958,41 @@ func main() {
 
 			mainApp.LogWindow = logWindow
 			startTime = time.Now()
-			for i := 0; i < len(checked); i++ {
-				resp := networkResponse{
-					ID:      checked[i],
-					Command: download,
-					Settings: settingsResponse{
-						SplitTransferSetting: splitTransferSettingResponse{
-							ChunkSize:     chunkSize,
-							ChunkParallel: chunkParallel,
-						},
-					},
-				}
-
-				for j := 0; j < len(downResp); j++ {
-					downResp[j].ID = i
-					downResp[j].Connection = parallel
-					downResp[j].StartIndex = int64(i) * (downResp[j].ContentLength / int64(len(checked)))
-					if i != 0 {
-						downResp[j].StartIndex++
-					}
+			ranges := job.missing()
+			if len(ranges) == 0 {
+				mainApp.completeJob(job)
+				return
+			}
 
-					downResp[j].LastIndex = int64(i+1) * (downResp[j].ContentLength / int64(len(checked)))
-					if i == len(checked)-1 {
-						downResp[j].LastIndex = downResp[j].ContentLength
-					}
+			job.Agents = checked
+			job.Connection = parallel
+			job.Settings = settingsResponse{
+				SplitTransferSetting: splitTransferSettingResponse{
+					ChunkSize:     chunkSize,
+					ChunkParallel: chunkParallel,
+				},
+				RetrySetting: retrySettingResponse{
+					Count: retry,
+				},
+			}
+
+			switch {
+			case singleStream:
+				job.singleStream()
+			case schedulerSelect.Selected == "Static":
+				job.Scheduler = scheduler.NewStatic(ranges, checked, job.missingIn)
+			default:
+				var total int64
+				for _, r := range ranges {
+					total += r.Len()
 				}
+				job.Scheduler = scheduler.NewDynamic(ranges, total/int64(len(checked)*partsPerClient), job.missingIn)
+			}
 
-				resp.Download = downResp
-				sendResponse(resp)
+			for _, id := range checked {
+				if resp, ok := job.next(id); ok {
+					sendResponse(resp)
+				}
 			}
 		}()
 	}
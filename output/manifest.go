@@ -0,0 +1,120 @@
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// ManifestSuffix is appended to the destination path of the sidecar file that
+// records which byte ranges of the part file are already on disk.
+const ManifestSuffix = PartSuffix + ".json"
+
+// Range is an inclusive byte range. Last is -1 when the range runs to the end
+// of a file of unknown length.
+type Range struct {
+	Start int64 `json:"start"`
+	Last  int64 `json:"last"`
+}
+
+func (r Range) Len() int64 {
+	return r.Last - r.Start + 1
+}
+
+// Manifest describes a download. Length is -1 until the length of the file
+// is known.
+type Manifest struct {
+	URL          string  `json:"url"`
+	ETag         string  `json:"etag"`
+	LastModified string  `json:"last_modified"`
+	Length       int64   `json:"length"`
+	Completed    []Range `json:"completed"`
+}
+
+// matches reports whether a download described by m can be resumed from the
+// data recorded in o. Validators are compared when the server sent them,
+// otherwise the URL has to be the same.
+func (m Manifest) matches(o Manifest) bool {
+	if m.Length != o.Length {
+		return false
+	}
+	if len(m.ETag) != 0 || len(o.ETag) != 0 {
+		return m.ETag == o.ETag
+	}
+	if len(m.LastModified) != 0 || len(o.LastModified) != 0 {
+		return m.LastModified == o.LastModified
+	}
+	return m.URL == o.URL
+}
+
+// add records r as completed, merging it with adjacent or overlapping ranges.
+func (m *Manifest) add(r Range) {
+	ranges := append(m.Completed, r)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	merged := ranges[:1]
+	for _, item := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if item.Start <= last.Last+1 {
+			if item.Last > last.Last {
+				last.Last = item.Last
+			}
+			continue
+		}
+		merged = append(merged, item)
+	}
+	m.Completed = merged
+}
+
+// Missing returns the ranges of the file that are not completed yet. For a
+// file of unknown length, everything after the completed prefix is missing.
+func (m Manifest) Missing() []Range {
+	if m.Length < 0 {
+		next := int64(0)
+		if len(m.Completed) != 0 && m.Completed[0].Start == 0 {
+			next = m.Completed[0].Last + 1
+		}
+		return []Range{{Start: next, Last: -1}}
+	}
+
+	var missing []Range
+	next := int64(0)
+	for _, r := range m.Completed {
+		if r.Start > next {
+			missing = append(missing, Range{Start: next, Last: r.Start - 1})
+		}
+		if r.Last+1 > next {
+			next = r.Last + 1
+		}
+	}
+	if next < m.Length {
+		missing = append(missing, Range{Start: next, Last: m.Length - 1})
+	}
+	return missing
+}
+
+func loadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var m Manifest
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// save writes m to path through a temporary file so a crash never leaves a
+// truncated manifest behind.
+func (m Manifest) save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,165 @@
+// Package output writes downloaded data straight to its destination file.
+// The file is preallocated to its full length and every received piece is
+// written at its absolute offset, so nothing has to be merged in memory. The
+// completed ranges are recorded in a sidecar manifest so an interrupted
+// download can be resumed.
+package output
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// PartSuffix is appended to the destination path until the download is
+// committed.
+const PartSuffix = ".part"
+
+// saveInterval limits how often the manifest is rewritten while data is
+// arriving. Ranges written after the last save are downloaded again on
+// resume.
+const saveInterval = time.Second
+
+var ErrOutOfRange = errors.New("write out of file range")
+
+type File struct {
+	Path string
+	Size int64
+
+	file     *os.File
+	mu       sync.Mutex
+	manifest Manifest
+	saved    time.Time
+	closed   bool
+}
+
+// Open opens the part file of path for the download described by manifest.
+// If a part file and a matching manifest already exist, the completed ranges
+// are kept; otherwise a new part file preallocated to manifest.Length is
+// created. A file of unknown length grows as data is written.
+func Open(path string, manifest Manifest) (*File, error) {
+	manifest.Completed = nil
+	if prev, err := loadManifest(path + ManifestSuffix); err == nil && manifest.matches(prev) {
+		if info, err := os.Stat(path + PartSuffix); err == nil && (manifest.Length < 0 || info.Size() == manifest.Length) {
+			f, err := os.OpenFile(path+PartSuffix, os.O_RDWR, 0644)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Completed = prev.Completed
+			return &File{Path: path, Size: manifest.Length, file: f, manifest: manifest}, nil
+		}
+	}
+
+	f, err := os.OpenFile(path+PartSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Length > 0 {
+		if err := preallocate(f, manifest.Length); err != nil {
+			_ = f.Close()
+			_ = os.Remove(path + PartSuffix)
+			return nil, err
+		}
+	}
+
+	file := &File{Path: path, Size: manifest.Length, file: f, manifest: manifest}
+	if err := file.manifest.save(path + ManifestSuffix); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// WriteAt writes p at offset off and records the range as completed. It is
+// safe for concurrent use.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || (f.Size >= 0 && off+int64(len(p)) > f.Size) {
+		return 0, ErrOutOfRange
+	}
+
+	n, err := f.file.WriteAt(p, off)
+	if n > 0 {
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return n, os.ErrClosed
+		}
+		f.manifest.add(Range{Start: off, Last: off + int64(n) - 1})
+		if time.Now().Sub(f.saved) >= saveInterval {
+			f.saved = time.Now()
+			_ = f.manifest.save(f.Path + ManifestSuffix)
+		}
+		f.mu.Unlock()
+	}
+	return n, err
+}
+
+// SetSize sets the length of a file whose length was unknown when it was
+// opened, once the stream feeding it has ended.
+func (f *File) SetSize(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Size >= 0 {
+		return nil
+	}
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.Size = size
+	f.manifest.Length = size
+	return f.manifest.save(f.Path + ManifestSuffix)
+}
+
+// Missing returns the ranges that still have to be downloaded.
+func (f *File) Missing() []Range {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.manifest.Missing()
+}
+
+// Close saves the manifest and closes the file, leaving the partial data on
+// disk to be resumed later.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	err := f.manifest.save(f.Path + ManifestSuffix)
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Commit flushes the file, renames it to its destination path and removes
+// the manifest.
+func (f *File) Commit() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	if err := f.file.Sync(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Path+PartSuffix, f.Path); err != nil {
+		return err
+	}
+	_ = os.Remove(f.Path + ManifestSuffix)
+	return nil
+}
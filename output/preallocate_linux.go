@@ -0,0 +1,15 @@
+//go:build linux
+
+package output
+
+import (
+	"os"
+	"syscall"
+)
+
+func preallocate(f *os.File, size int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, size); err == nil {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package output
+
+import (
+	"os"
+)
+
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,118 @@
+// Package planner cuts byte ranges into parts. Every function returns
+// non-overlapping inclusive ranges that cover its input exactly, in order.
+package planner
+
+// Range is an inclusive byte range of the file at index File. Last is -1 when
+// the range runs to the end of a file of unknown length.
+type Range struct {
+	File  int
+	Start int64
+	Last  int64
+}
+
+func (r Range) Len() int64 {
+	return r.Last - r.Start + 1
+}
+
+// Bounded reports whether the end of r is known.
+func (r Range) Bounded() bool {
+	return r.Last >= 0
+}
+
+// Split cuts r into at most n parts whose lengths differ by at most one byte.
+// Fewer parts are returned when that keeps every part at least minSize bytes
+// long. An unbounded range is returned as a single part.
+func Split(r Range, n int, minSize int64) []Range {
+	if !r.Bounded() {
+		return []Range{r}
+	}
+
+	length := r.Len()
+	if length <= 0 {
+		return nil
+	}
+	if minSize > 0 && int64(n) > length/minSize {
+		n = int(length / minSize)
+	}
+	if int64(n) > length {
+		n = int(length)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	size, extra := length/int64(n), length%int64(n)
+	parts := make([]Range, 0, n)
+	start := r.Start
+	for i := 0; i < n; i++ {
+		partSize := size
+		if int64(i) < extra {
+			partSize++
+		}
+		parts = append(parts, Range{File: r.File, Start: start, Last: start + partSize - 1})
+		start += partSize
+	}
+	return parts
+}
+
+// Chunk cuts ranges into parts of size bytes; the last part of each range may
+// be shorter. Unbounded ranges are kept whole.
+func Chunk(ranges []Range, size int64) []Range {
+	var parts []Range
+	for _, r := range ranges {
+		if !r.Bounded() || size <= 0 {
+			parts = append(parts, r)
+			continue
+		}
+		for start := r.Start; start <= r.Last; start += size {
+			last := start + size - 1
+			if last > r.Last {
+				last = r.Last
+			}
+			parts = append(parts, Range{File: r.File, Start: start, Last: last})
+		}
+	}
+	return parts
+}
+
+// Divide cuts bounded ranges into n shares whose total lengths differ by at
+// most one byte. A share may hold several ranges, possibly of different
+// files, and is empty when there are fewer bytes than shares.
+func Divide(ranges []Range, n int) [][]Range {
+	if n < 1 {
+		n = 1
+	}
+
+	var total int64
+	for _, r := range ranges {
+		total += r.Len()
+	}
+	quota := func(k int) int64 {
+		q := total / int64(n)
+		if int64(k) < total%int64(n) {
+			q++
+		}
+		return q
+	}
+
+	shares := make([][]Range, n)
+	k, left := 0, quota(0)
+	for _, r := range ranges {
+		for start := r.Start; start <= r.Last; {
+			for left == 0 {
+				k++
+				left = quota(k)
+			}
+
+			last := start + left - 1
+			if last > r.Last {
+				last = r.Last
+			}
+			shares[k] = append(shares[k], Range{File: r.File, Start: start, Last: last})
+
+			left -= last - start + 1
+			start = last + 1
+		}
+	}
+	return shares
+}
@@ -0,0 +1,164 @@
+package planner
+
+import (
+	"math/rand"
+	"testing"
+)
+
+const iterations = 2000
+
+// randomRanges returns up to 4 non-overlapping bounded ranges of up to 3
+// files, some of them a single byte long.
+func randomRanges(rnd *rand.Rand) []Range {
+	var ranges []Range
+	for file := 0; file < 1+rnd.Intn(3); file++ {
+		start := rnd.Int63n(1 << 16)
+		for i := 0; i < rnd.Intn(3); i++ {
+			r := Range{File: file, Start: start, Last: start + rnd.Int63n(1<<16)}
+			if rnd.Intn(5) == 0 {
+				r.Last = r.Start
+			}
+			ranges = append(ranges, r)
+			start = r.Last + 2 + rnd.Int63n(1<<10)
+		}
+	}
+	return ranges
+}
+
+// checkCover fails unless parts cover ranges exactly, in order: the parts of
+// every range start at its start, follow each other without gap or overlap,
+// and end at its end.
+func checkCover(t *testing.T, ranges, parts []Range) {
+	t.Helper()
+	i := 0
+	for _, r := range ranges {
+		next := r.Start
+		for next <= r.Last {
+			if i == len(parts) {
+				t.Fatalf("%v: missing bytes %d-%d of %v", parts, next, r.Last, r)
+			}
+			p := parts[i]
+			if p.File != r.File || p.Start != next || p.Last < p.Start || p.Last > r.Last {
+				t.Fatalf("%v: part %v does not continue %v at %d", parts, p, r, next)
+			}
+			next = p.Last + 1
+			i++
+		}
+	}
+	if i != len(parts) {
+		t.Fatalf("%v: %d extra parts after covering %v", parts, len(parts)-i, ranges)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for it := 0; it < iterations; it++ {
+		r := Range{File: rnd.Intn(3), Start: rnd.Int63n(1 << 30)}
+		r.Last = r.Start + rnd.Int63n(1<<rnd.Intn(24))
+		n := rnd.Intn(64)
+		minSize := rnd.Int63n(1 << rnd.Intn(20))
+
+		parts := Split(r, n, minSize)
+		checkCover(t, []Range{r}, parts)
+
+		if len(parts) > n && len(parts) > 1 {
+			t.Fatalf("Split(%v, %d, %d): %d parts", r, n, minSize, len(parts))
+		}
+		min, max := parts[0].Len(), parts[0].Len()
+		for _, p := range parts {
+			if p.Len() < min {
+				min = p.Len()
+			}
+			if p.Len() > max {
+				max = p.Len()
+			}
+		}
+		if max-min > 1 {
+			t.Fatalf("Split(%v, %d, %d): part lengths from %d to %d", r, n, minSize, min, max)
+		}
+		if len(parts) > 1 && min < minSize {
+			t.Fatalf("Split(%v, %d, %d): part of %d bytes", r, n, minSize, min)
+		}
+		// one more part would break minSize or the byte count
+		if more := int64(len(parts) + 1); len(parts) < n && more <= r.Len() && (minSize <= 0 || r.Len()/more >= minSize) {
+			t.Fatalf("Split(%v, %d, %d): only %d parts", r, n, minSize, len(parts))
+		}
+	}
+}
+
+func TestSplitUnbounded(t *testing.T) {
+	r := Range{File: 1, Start: 100, Last: -1}
+	parts := Split(r, 8, 1)
+	if len(parts) != 1 || parts[0] != r {
+		t.Fatalf("Split(%v) = %v", r, parts)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for it := 0; it < iterations; it++ {
+		ranges := randomRanges(rnd)
+		size := 1 + rnd.Int63n(1<<(4+rnd.Intn(14)))
+
+		parts := Chunk(ranges, size)
+		checkCover(t, ranges, parts)
+
+		for i, p := range parts {
+			if p.Len() > size {
+				t.Fatalf("Chunk(%v, %d): part %v", ranges, size, p)
+			}
+			// only the last part of a range may be shorter
+			last := i == len(parts)-1 || parts[i+1].File != p.File || parts[i+1].Start != p.Last+1
+			if !last && p.Len() != size {
+				t.Fatalf("Chunk(%v, %d): short part %v", ranges, size, p)
+			}
+		}
+	}
+}
+
+func TestChunkUnbounded(t *testing.T) {
+	ranges := []Range{{File: 0, Start: 0, Last: 9}, {File: 1, Start: 5, Last: -1}}
+	parts := Chunk(ranges, 4)
+	want := []Range{{0, 0, 3}, {0, 4, 7}, {0, 8, 9}, {1, 5, -1}}
+	if len(parts) != len(want) {
+		t.Fatalf("Chunk(%v, 4) = %v", ranges, parts)
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Fatalf("Chunk(%v, 4) = %v", ranges, parts)
+		}
+	}
+}
+
+func TestDivide(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	for it := 0; it < iterations; it++ {
+		ranges := randomRanges(rnd)
+		n := 1 + rnd.Intn(16)
+
+		shares := Divide(ranges, n)
+		if len(shares) != n {
+			t.Fatalf("Divide(%v, %d): %d shares", ranges, n, len(shares))
+		}
+		var parts []Range
+		min, max := int64(-1), int64(0)
+		for _, share := range shares {
+			var total int64
+			for _, p := range share {
+				total += p.Len()
+			}
+			if min < 0 || total < min {
+				min = total
+			}
+			if total > max {
+				max = total
+			}
+			parts = append(parts, share...)
+		}
+		// a range cut at a share boundary continues in the next share
+		checkCover(t, ranges, parts)
+		if max-min > 1 {
+			t.Fatalf("Divide(%v, %d): shares from %d to %d bytes", ranges, n, min, max)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// probe requests the first byte of uri with the headers h to learn the length
+// of the file and whether the origin supports range requests. ContentLength
+// is -1 when the origin does not tell the length.
+func probe(uri string, h http.Header) (downloadResponse, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return downloadResponse{}, false, err
+	}
+	req.Header = h.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return downloadResponse{}, false, err
+	}
+
+	file := downloadResponse{
+		Type:          generalFile,
+		URL:           uri,
+		ContentLength: -1,
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		Header:        h,
+	}
+
+	var ranges bool
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		ranges = true
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if n, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				file.ContentLength = n
+			}
+		}
+	case http.StatusOK:
+		file.ContentLength = resp.ContentLength
+	default:
+		return downloadResponse{}, false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err != nil || len(params["filename"]) == 0 {
+		u, _ := url.Parse(uri)
+		paths := strings.Split(u.Path, "/")
+		if len(paths) != 0 && len(paths[len(paths)-1]) != 0 {
+			file.Filename = paths[len(paths)-1]
+		} else {
+			file.Filename = "unknown"
+		}
+	} else {
+		file.Filename = params["filename"]
+	}
+	return file, ranges, nil
+}
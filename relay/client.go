@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	maxLine     = 4096
+)
+
+// NewRoom returns a random room ID.
+func NewRoom() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Dial joins room at the relay at addr as an agent. The returned connection
+// leads to the downloader of the room.
+func Dial(addr, room string) (net.Conn, error) {
+	return open(addr, message{Role: roleAgent, Room: room})
+}
+
+// Listen registers as the downloader of room at the relay at addr. Accept
+// returns the connections of the agents that join the room.
+func Listen(addr, room string) (net.Listener, error) {
+	control, err := open(addr, message{Role: roleDownloader, Room: room})
+	if err != nil {
+		return nil, err
+	}
+	return &listener{addr: addr, room: room, control: control, reader: bufio.NewReader(control)}, nil
+}
+
+type listener struct {
+	addr    string
+	room    string
+	control net.Conn
+	reader  *bufio.Reader
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		line, err := l.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		var msg message
+		if json.Unmarshal(line, &msg) != nil || len(msg.Session) == 0 {
+			continue
+		}
+		conn, err := open(l.addr, message{Role: roleAccept, Room: l.room, Session: msg.Session})
+		if err != nil {
+			log.Printf("relay: cannot accept session %s: %s", msg.Session, err)
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func (l *listener) Close() error {
+	return l.control.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.control.RemoteAddr()
+}
+
+// open connects to the relay at addr, sends msg and waits for the answer.
+func open(addr string, msg message) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMessage(conn, msg); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(AcceptTimeout + dialTimeout))
+	line, err := readLine(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	var resp message
+	if err == nil {
+		err = json.Unmarshal(line, &resp)
+	}
+	if err == nil && len(resp.Error) != 0 {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readLine reads up to a newline one byte at a time, so nothing after it is
+// taken from conn.
+func readLine(conn net.Conn) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		if len(line) == maxLine {
+			return nil, errors.New("relay: answer too long")
+		}
+		line = append(line, b[0])
+	}
+}
@@ -0,0 +1,237 @@
+// Package relay connects agents and downloaders that cannot accept inbound
+// connections. Both sides connect out to the relay and join a room; every
+// agent that joins is spliced to a connection the downloader of the room
+// opens for it, so the relay only forwards bytes and TLS stays end to end.
+//
+// A connection starts with a JSON line saying what it is for. The downloader
+// keeps a control connection on which the relay announces every agent with a
+// session ID, and answers each with an accept connection for that session.
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptTimeout is how long an agent waits for the downloader of its room.
+const AcceptTimeout = 15 * time.Second
+
+// pingInterval keeps the control connection of a downloader alive through
+// NATs.
+const pingInterval = 30 * time.Second
+
+const (
+	roleDownloader = "downloader"
+	roleAgent      = "agent"
+	roleAccept     = "accept"
+)
+
+var (
+	ErrNoDownloader = errors.New("no downloader in the room")
+	ErrRoomTaken    = errors.New("the room has a downloader already")
+	ErrNoSession    = errors.New("unknown session")
+)
+
+type message struct {
+	Role    string `json:"role,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Session string `json:"session,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func writeMessage(w io.Writer, msg message) error {
+	b, _ := json.Marshal(msg)
+	_, err := w.Write(append(b, '\n'))
+	return err
+}
+
+type session struct {
+	room     string
+	accepted chan io.ReadWriteCloser
+}
+
+// Server pairs the agents and downloaders of every room.
+type Server struct {
+	mu       sync.Mutex
+	rooms    map[string]net.Conn
+	sessions map[string]*session
+}
+
+func NewServer() *Server {
+	return &Server{
+		rooms:    make(map[string]net.Conn),
+		sessions: make(map[string]*session),
+	}
+}
+
+// Serve handles the connections accepted by l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	// the first line comes before anything is known of the peer, so it
+	// must fit in the buffer
+	reader := bufio.NewReaderSize(conn, maxLine)
+	_ = conn.SetReadDeadline(time.Now().Add(AcceptTimeout))
+	line, err := reader.ReadSlice('\n')
+	_ = conn.SetReadDeadline(time.Time{})
+	var msg message
+	if err != nil || json.Unmarshal(line, &msg) != nil || len(msg.Room) == 0 {
+		_ = conn.Close()
+		return
+	}
+
+	switch msg.Role {
+	case roleDownloader:
+		s.control(conn, reader, msg.Room)
+	case roleAgent:
+		s.join(conn, reader, msg.Room)
+	case roleAccept:
+		s.accept(conn, reader, msg.Room, msg.Session)
+	default:
+		_ = conn.Close()
+	}
+}
+
+// control registers the downloader of room for as long as conn is open.
+func (s *Server) control(conn net.Conn, reader *bufio.Reader, room string) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	if _, ok := s.rooms[room]; ok {
+		s.mu.Unlock()
+		_ = writeMessage(conn, message{Error: ErrRoomTaken.Error()})
+		return
+	}
+	s.rooms[room] = conn
+	_ = writeMessage(conn, message{Room: room})
+	s.mu.Unlock()
+	log.Printf("Room %s: downloader %s", room, conn.RemoteAddr())
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				_, _ = conn.Write([]byte{'\n'})
+				s.mu.Unlock()
+			}
+		}
+	}()
+
+	_, _ = io.Copy(io.Discard, reader)
+	close(done)
+
+	s.mu.Lock()
+	delete(s.rooms, room)
+	s.mu.Unlock()
+	log.Printf("Room %s: downloader left", room)
+}
+
+// join announces the agent on conn to the downloader of room and splices it
+// with the accept connection the downloader opens for it.
+func (s *Server) join(conn net.Conn, reader *bufio.Reader, room string) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	sess := &session{room: room, accepted: make(chan io.ReadWriteCloser, 1)}
+
+	s.mu.Lock()
+	control, ok := s.rooms[room]
+	if ok {
+		s.sessions[id] = sess
+		if err := writeMessage(control, message{Session: id}); err != nil {
+			delete(s.sessions, id)
+			ok = false
+		}
+	}
+	s.mu.Unlock()
+
+	var downloader io.ReadWriteCloser
+	if ok {
+		timer := time.NewTimer(AcceptTimeout)
+		select {
+		case downloader = <-sess.accepted:
+		case <-timer.C:
+			s.mu.Lock()
+			_, pending := s.sessions[id]
+			delete(s.sessions, id)
+			s.mu.Unlock()
+			if !pending {
+				// accept took the session just before the timeout.
+				downloader = <-sess.accepted
+			}
+		}
+		timer.Stop()
+	}
+	if downloader == nil {
+		_ = writeMessage(conn, message{Error: ErrNoDownloader.Error()})
+		_ = conn.Close()
+		return
+	}
+
+	_ = writeMessage(conn, message{Room: room})
+	splice(struct {
+		io.Reader
+		io.WriteCloser
+	}{reader, conn}, downloader)
+}
+
+// accept hands conn to the agent of session in room.
+func (s *Server) accept(conn net.Conn, reader *bufio.Reader, room, id string) {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	if ok && sess.room == room {
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+
+	if !ok || sess.room != room {
+		_ = writeMessage(conn, message{Error: ErrNoSession.Error()})
+		_ = conn.Close()
+		return
+	}
+
+	_ = writeMessage(conn, message{Room: room, Session: id})
+	sess.accepted <- struct {
+		io.Reader
+		io.WriteCloser
+	}{reader, conn}
+}
+
+// splice copies between a and b until either side closes, then closes both.
+func splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
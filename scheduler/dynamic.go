@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"github.com/yms2772/download_accelerator/planner"
+)
+
+// MinSteal is the smallest missing span that is split to give an idle agent
+// part of another agent's range.
+const MinSteal = 1 << 20
+
+// Dynamic hands out parts of at most partSize bytes on demand. Once every part
+// is claimed, an idle agent takes over the upper half of the largest span
+// another agent has not downloaded yet.
+type Dynamic struct {
+	tracker
+	partSize int64
+	pending  []Range
+}
+
+var _ Scheduler = (*Dynamic)(nil)
+
+func NewDynamic(ranges []Range, partSize int64, missing MissingFunc) *Dynamic {
+	if partSize <= 0 {
+		partSize = MinSteal
+	}
+
+	d := &Dynamic{tracker: newTracker(missing), partSize: partSize}
+	d.pending = planner.Chunk(ranges, partSize)
+	return d
+}
+
+func (d *Dynamic) Next(agent string) []Range {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.pending) != 0 {
+		r := d.pending[0]
+		d.pending = d.pending[1:]
+		d.running[agent] = append(d.running[agent], r)
+		return []Range{r}
+	}
+
+	r, ok := d.steal(agent)
+	if !ok {
+		return nil
+	}
+	d.running[agent] = append(d.running[agent], r)
+	return []Range{r}
+}
+
+// steal returns the upper half of the largest span still missing from the
+// ranges of the other agents and leaves the owner responsible for the rest.
+// The owner keeps downloading the stolen span as well; the first copy to
+// arrive is kept, and Done is true as soon as every span is on disk, so the
+// job does not wait for the owner. Must be called with d.mu held.
+func (d *Dynamic) steal(agent string) (Range, bool) {
+	var (
+		largest Range
+		owner   string
+		index   int
+	)
+	for id, ranges := range d.running {
+		if id == agent {
+			continue
+		}
+		for i, r := range ranges {
+			for _, m := range d.missing(r) {
+				if len(owner) == 0 || m.Len() > largest.Len() {
+					largest, owner, index = m, id, i
+				}
+			}
+		}
+	}
+	if len(owner) == 0 || largest.Len() < 2*MinSteal {
+		return Range{}, false
+	}
+
+	stolen := largest
+	stolen.Start += largest.Len() / 2
+
+	r := d.running[owner][index]
+	kept := []Range{{File: r.File, Start: r.Start, Last: stolen.Start - 1}}
+	if stolen.Last < r.Last {
+		kept = append(kept, Range{File: r.File, Start: stolen.Last + 1, Last: r.Last})
+	}
+	ranges := append([]Range{}, d.running[owner][:index]...)
+	ranges = append(ranges, kept...)
+	d.running[owner] = append(ranges, d.running[owner][index+1:]...)
+	return stolen, true
+}
+
+func (d *Dynamic) Complete(agent string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending = append(planner.Chunk(d.release(agent), d.partSize), d.pending...)
+}
+
+// Release puts what the agent left behind in front of the pending parts.
+func (d *Dynamic) Release(agent string) []Range {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	released := d.release(agent)
+	d.pending = append(planner.Chunk(released, d.partSize), d.pending...)
+	return released
+}
+
+func (d *Dynamic) Done() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.pending) == 0 && d.done()
+}
@@ -0,0 +1,77 @@
+// Package scheduler decides which byte ranges each agent downloads.
+package scheduler
+
+import (
+	"sync"
+
+	"github.com/yms2772/download_accelerator/planner"
+)
+
+// Range is an inclusive byte range of the file at index File of a job.
+type Range = planner.Range
+
+// MissingFunc returns the parts of r that are not on disk yet.
+type MissingFunc func(r Range) []Range
+
+type Scheduler interface {
+	// Next returns the ranges the agent should download next. It returns nil
+	// when there is nothing left to hand out.
+	Next(agent string) []Range
+	// Complete tells the scheduler that the agent finished every range it was
+	// handed. Parts that are still not on disk, because the agent failed to
+	// download them, are handed out again by Next.
+	Complete(agent string)
+	// Release takes back the ranges of an agent that disconnected and returns
+	// the parts that are not on disk yet. They are handed out again by Next.
+	Release(agent string) []Range
+	// Idle reports whether the agent has no range to work on.
+	Idle(agent string) bool
+	// Done reports whether every range of the job is on disk.
+	Done() bool
+}
+
+// tracker keeps the ranges each agent is working on.
+type tracker struct {
+	mu      sync.Mutex
+	running map[string][]Range
+	missing MissingFunc
+}
+
+func newTracker(missing MissingFunc) tracker {
+	return tracker{
+		running: make(map[string][]Range),
+		missing: missing,
+	}
+}
+
+func (t *tracker) Idle(agent string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.running[agent]) == 0
+}
+
+// release forgets the ranges of the agent and returns their parts that are
+// not on disk yet. Must be called with t.mu held.
+func (t *tracker) release(agent string) []Range {
+	var missing []Range
+	for _, r := range t.running[agent] {
+		missing = append(missing, t.missing(r)...)
+	}
+	delete(t.running, agent)
+	return missing
+}
+
+// done reports whether every running range is already on disk. A range can
+// be finished by another agent that stole its tail. Must be called with t.mu
+// held.
+func (t *tracker) done() bool {
+	for _, ranges := range t.running {
+		for _, r := range ranges {
+			if len(t.missing(r)) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
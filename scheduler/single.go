@@ -0,0 +1,54 @@
+package scheduler
+
+// Single hands every range to one agent at a time, for origins that do not
+// support ranges or do not tell the length of the file. A range may be
+// unbounded, with Last set to -1.
+type Single struct {
+	tracker
+	pending []Range
+}
+
+var _ Scheduler = (*Single)(nil)
+
+func NewSingle(ranges []Range, missing MissingFunc) *Single {
+	return &Single{
+		tracker: newTracker(missing),
+		pending: ranges,
+	}
+}
+
+func (s *Single) Next(agent string) []Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 || len(s.running) != 0 {
+		return nil
+	}
+	ranges := s.pending
+	s.pending = nil
+	s.running[agent] = ranges
+	return ranges
+}
+
+func (s *Single) Complete(agent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, s.release(agent)...)
+}
+
+func (s *Single) Release(agent string) []Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := s.release(agent)
+	s.pending = append(s.pending, released...)
+	return released
+}
+
+func (s *Single) Done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pending) == 0 && s.done()
+}
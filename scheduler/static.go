@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"github.com/yms2772/download_accelerator/planner"
+)
+
+// Static divides the job into one equal share per agent up front, so the job
+// finishes at the speed of the slowest agent.
+type Static struct {
+	tracker
+	agents  int
+	shares  map[string][]Range
+	pending [][]Range
+}
+
+var _ Scheduler = (*Static)(nil)
+
+func NewStatic(ranges []Range, agents []string, missing MissingFunc) *Static {
+	s := &Static{
+		tracker: newTracker(missing),
+		agents:  len(agents),
+		shares:  make(map[string][]Range),
+	}
+	for i, share := range planner.Divide(ranges, len(agents)) {
+		if len(share) != 0 {
+			s.shares[agents[i]] = share
+		}
+	}
+	return s
+}
+
+func (s *Static) Next(agent string) []Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share := s.shares[agent]
+	if len(share) == 0 {
+		if len(s.pending) == 0 {
+			return nil
+		}
+		share = s.pending[0]
+		s.pending = s.pending[1:]
+	}
+	delete(s.shares, agent)
+	s.running[agent] = share
+	return share
+}
+
+func (s *Static) Complete(agent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requeue(s.release(agent))
+}
+
+// Release splits what the agent left behind equally among the other agents.
+func (s *Static) Release(agent string) []Range {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := append(s.release(agent), s.shares[agent]...)
+	delete(s.shares, agent)
+	if len(released) == 0 {
+		return nil
+	}
+
+	if s.agents > 1 {
+		s.agents--
+	}
+	s.requeue(released)
+	return released
+}
+
+// requeue splits ranges into a pending share per agent. Must be called with
+// s.mu held.
+func (s *Static) requeue(ranges []Range) {
+	for _, share := range planner.Divide(ranges, s.agents) {
+		if len(share) != 0 {
+			s.pending = append(s.pending, share)
+		}
+	}
+}
+
+func (s *Static) Done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.shares) == 0 && len(s.pending) == 0 && s.done()
+}
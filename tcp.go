@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -15,6 +14,10 @@ import (
 	"time"
 
 	"github.com/yms2772/download_accelerator/cmd"
+	"github.com/yms2772/download_accelerator/frame"
+	"github.com/yms2772/download_accelerator/identity"
+	"github.com/yms2772/download_accelerator/relay"
+	"github.com/yms2772/download_accelerator/transport"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
@@ -23,194 +26,234 @@ import (
 	"github.com/dustin/go-humanize"
 )
 
-type uploadResult struct {
-	ID   int
-	Data []byte
-}
-
 type connectionData struct {
-	Upload         []uploadResult
 	Conn           net.Conn
+	Writer         *frame.Writer
+	Hello          helloResponse
 	LastConnection time.Time
 }
 
+// resumeTimeout is how long the ranges of a client that lost its connection
+// during a job wait for it to reconnect with the same session before they are
+// handed to the other clients.
+const resumeTimeout = 10 * time.Second
+
+// redialDelay is the time between two connection attempts to an agent added
+// by address or to a relay.
+const redialDelay = 5 * time.Second
+
 var (
-	startTime         time.Time
-	connections       = make(map[string]*connectionData)
-	splitTransferData = make(map[string][][]byte)
+	startTime  time.Time
+	currentJob *jobData
+
+	// connections holds the accepted clients, written by the goroutine of
+	// every connection and by refreshClient.
+	connections   = make(map[string]*connectionData)
+	connectionsMu sync.Mutex
+
+	// lost holds the session of the clients that lost their connection
+	// during a job, until they resume it or resumeTimeout passes.
+	lost   = make(map[string]lostClient)
+	lostMu sync.Mutex
 )
 
-func decompress(compressed [][]byte) [][]byte {
-	wg := new(sync.WaitGroup)
-	result := make([][]byte, len(compressed))
-	for i, data := range compressed {
-		wg.Add(1)
-		gz, err := gzip.NewReader(bytes.NewBuffer(data))
-		if err != nil {
-			return nil
+type lostClient struct {
+	Session string
+	Since   time.Time
+}
+
+// newConnection serves the connection of an agent until it is closed, and
+// reports whether the agent was refused.
+func (m *mainAppData) newConnection(conn net.Conn) bool {
+	defer conn.Close()
+	writer := frame.NewWriter(conn)
+	defer writer.Close()
+
+	var (
+		id       string
+		greeting *helloResponse
+		offer    helloResponse
+		nonce    []byte
+		accepted *helloResponse
+		status   string
+		refused  bool
+		key      []byte
+		// stale holds the jobs the agent was told to stop on this
+		// connection, so it is told once however many frames are in flight
+		stale = make(map[uint32]bool)
+	)
+	// cancelStale tells the agent to stop job, which is not the current job,
+	// like the work of a job of a previous run it resumes after a restart of
+	// the downloader.
+	cancelStale := func(job uint32) {
+		if stale[job] {
+			return
 		}
-		go func(reader *gzip.Reader, n int) {
-			defer wg.Done()
-			result[n], _ = io.ReadAll(reader)
-		}(gz, i)
+		stale[job] = true
+		m.logEvent(id, fmt.Sprintf("Job %d is over, telling the client to stop it", job))
+		writeResponse(writer, networkResponse{ID: id, Job: job, Command: cancelDownload})
+	}
+	// refuse shows the reason in the client list only for a paired key or a
+	// client listed already, so peers scanning the port do not fill the list.
+	refuse := func(reason string) {
+		refused = true
+		writeResponse(writer, networkResponse{ID: id, Command: hello, Hello: helloResponse{Version: protocolVersion, Reason: reason}})
+		if _, paired := m.Paired.Lookup(key); paired || m.clientRow(id) != nil {
+			m.showClient(id, reason, false)
+		}
+		log.Printf("Refused %s: %s", id, reason)
 	}
-	wg.Wait()
-	return result
-}
 
-func (m *mainAppData) newConnection(conn net.Conn) {
-	d := json.NewDecoder(conn)
-MAIN:
+	reader := bufio.NewReader(conn)
 	for {
-		var resp networkResponse
-		if err := d.Decode(&resp); err != nil {
+		h, payload, err := frame.Read(reader)
+		if err != nil {
 			break
 		}
 
+		switch h.Command {
+		case frame.Control:
+		case frame.Data:
+			if accepted != nil {
+				if job := currentJob; job == nil || job.ID != h.Job {
+					cancelStale(h.Job)
+				}
+				m.receiveData(id, writer, h, payload)
+			}
+			continue
+		default:
+			continue
+		}
+
+		var resp networkResponse
+		if err := json.Unmarshal(payload, &resp); err != nil {
+			continue
+		}
+
 		if len(resp.ID) == 0 {
 			continue
 		}
+		if accepted == nil {
+			id = resp.ID
+		} else if resp.ID != id {
+			continue
+		}
+		if accepted == nil && resp.Command != hello && resp.Command != challenge && resp.Command != keepAlive {
+			continue
+		}
 
 		switch resp.Command {
 		case errorOccurred:
 			m.Processing.Hide()
-			dialog.ShowError(resp.Error, m.Window)
+			dialog.ShowError(errors.New(resp.Error), m.Window)
 			continue
-		case keepAlive:
-			if _, ok := connections[resp.ID]; ok {
-				connections[resp.ID].LastConnection = time.Now()
+		case partError:
+			job := currentJob
+			if job == nil || job.ID != resp.Job || job.Finished {
 				continue
 			}
-			log.Printf("Connected: %s", resp.ID)
-			connections[resp.ID] = &connectionData{
-				Conn: conn,
-			}
-			m.Client.Content.(*fyne.Container).Add(widget.NewCheck(resp.ID, func(b bool) {}))
-			m.Client.Refresh()
-		case splitTransfer:
-			if resp.SplitTransfer.Done {
-				var merged []byte
-				for _, data := range splitTransferData[resp.ID] {
-					merged = append(merged, data...)
-				}
-
-				var mergedData networkResponse
-				if err := json.Unmarshal(merged, &mergedData); err != nil {
-					dialog.ShowError(resp.Error, m.Window)
-					continue
-				}
-
-				if connections[mergedData.ID] == nil {
-					connections[mergedData.ID] = &connectionData{}
-				}
-
-				if len(connections[mergedData.ID].Upload) != len(mergedData.Upload) {
-					connections[mergedData.ID].Upload = make([]uploadResult, len(mergedData.Upload))
-				}
-
-				for i, upload := range mergedData.Upload {
-					decompressed := decompress(upload.Data)
-					if decompressed == nil {
-						dialog.ShowError(errors.New("decompress failed"), m.Window)
-						continue MAIN
-					}
-					for _, data := range decompressed {
-						connections[mergedData.ID].Upload[i].Data = append(connections[mergedData.ID].Upload[i].Data, data...)
-					}
-					connections[mergedData.ID].Upload[i].ID = upload.ID
-				}
-
-				for _, connection := range connections {
-					if len(connection.Upload) == 0 {
-						continue MAIN
-					}
-					for _, data := range connection.Upload {
-						if len(data.Data) == 0 {
-							continue MAIN
-						}
-					}
-				}
-
-				mergedFileData := make([][][]byte, len(connections))
-				for _, connection := range connections {
-					for j, data := range connection.Upload {
-						if len(mergedFileData[data.ID]) == 0 {
-							mergedFileData[data.ID] = make([][]byte, len(mergedData.Upload))
-						}
-						mergedFileData[data.ID][j] = data.Data
-					}
-				}
-
-				totalData := make([][]byte, len(mergedData.Upload))
-				for _, data := range mergedFileData {
-					for i := 0; i < len(mergedData.Upload); i++ {
-						totalData[i] = append(totalData[i], data[i]...)
-					}
-				}
-
-				if len(totalData) == 0 {
-					continue
-				}
 
-				_ = os.Mkdir("downloaded", os.ModePerm)
-				for i := 0; i < len(mergedData.Upload); i++ {
-					_ = os.WriteFile("downloaded/"+mergedData.Upload[i].Filename, totalData[i], os.ModePerm)
+			partErr := resp.PartError
+			if partErr.RangeUnsupported {
+				if job.singleStream() {
+					m.logEvent(resp.ID, "The origin does not support ranges, downloading as a single stream")
 				}
-
-				switch mergedData.Upload[0].Type {
-				case generalFile:
-				case youtubeVideo:
-					if len(totalData) == 2 {
-						ffmpeg, ok := checkFFmpeg()
-						if !ok {
-							dialog.ShowError(errors.New("ffmpeg does not exist"), m.Window)
-							continue
-						}
-
-						if err := cmd.PrepareBackgroundCommand(exec.Command(ffmpeg, "-y",
-							"-i", "downloaded/"+mergedData.Upload[0].Filename,
-							"-i", "downloaded/"+mergedData.Upload[1].Filename,
-							"-c:v", "copy",
-							"-c:a", "copy",
-							"-shortest",
-							"downloaded/youtube_with_audio.mp4",
-							"-loglevel", "warning",
-						)).Run(); err != nil {
-							dialog.ShowError(errors.New("cannot merge audio"), m.Window)
-							continue
-						}
-
-						for i := 0; i < len(mergedData.Upload); i++ {
-							_ = os.Remove("downloaded/" + mergedData.Upload[i].Filename)
-						}
-					}
+				continue
+			}
+			if partErr.Changed {
+				m.logEvent(resp.ID, fmt.Sprintf("Part %d of %s: %s", partErr.Part, partErr.URL, partErr.Error))
+				if job.abort() {
+					cancelJob(job)
+					job.close()
+					m.Processing.Hide()
+					dialog.ShowError(fmt.Errorf("the file changed on the server during the download:\n%s\nenter the URL again to download the new version", partErr.Error), m.Window)
 				}
+				continue
+			}
 
-				for _, item := range m.Log {
-					objects := item.Content.(*fyne.Container).Objects
-					if len(objects) == 0 {
-						continue
-					}
-					objects[0].(*widget.Card).SetSubTitle("Download complete")
-					objects[0].(*widget.Card).Content.(*widget.ProgressBar).SetValue(1)
-				}
+			m.logEvent(resp.ID, fmt.Sprintf("Part %d failed after %d attempt(s) (status %d): %s, bytes %d-%d of %s",
+				partErr.Part, partErr.Attempts, partErr.StatusCode, partErr.Error, partErr.StartIndex, partErr.LastIndex, partErr.URL))
+			if job.fail() {
+				cancelJob(job)
+				job.close()
 				m.Processing.Hide()
-				dialog.ShowInformation("Done", fmt.Sprintf("Download complete\nElapsed time: %s", durationFormat(time.Now().Sub(startTime).Seconds())), m.Window)
+				dialog.ShowError(fmt.Errorf("too many failed parts, last error:\n%s\nstart the download again to resume", partErr.Error), m.Window)
+			}
+		case hello:
+			if greeting != nil || refused {
+				continue
+			}
+			key = resp.Hello.PublicKey
+			reply, text := negotiate(resp.Hello)
+			if !reply.Accepted {
+				refuse(reply.Reason)
 				continue
 			}
 
-			if resp.SplitTransfer.Index == -1 {
-				splitTransferData[resp.ID] = make([][]byte, resp.SplitTransfer.Total)
-				connections[resp.ID].Upload = []uploadResult{}
+			reply.Window = m.AgentBuffer
+			greeting, offer, status = &resp.Hello, reply, text
+			nonce = identity.NewNonce()
+			writeResponse(writer, networkResponse{ID: id, Command: challenge, Challenge: challengeResponse{Nonce: nonce}})
+		case challenge:
+			if greeting == nil || accepted != nil || refused {
+				continue
+			}
+			if err := m.authenticate(*greeting, id, nonce, resp.Challenge); err != nil {
+				refuse(err.Error())
 				continue
 			}
 
-			card := m.Log[resp.ID].Content.(*fyne.Container).Objects[0].(*widget.Card)
-			nowProgress := float64(resp.SplitTransfer.Index) / float64(resp.SplitTransfer.Total)
-			if card.Content.(*widget.ProgressBar).Value < nowProgress {
-				card.Content.(*widget.ProgressBar).SetValue(nowProgress)
+			writeResponse(writer, networkResponse{ID: id, Command: hello, Hello: offer})
+			m.showClient(id, status, true)
+			log.Printf("Connected: %s (%s)", id, status)
+			accepted = greeting
+			m.resume(id, accepted.Session)
+			setConnection(id, &connectionData{
+				Conn:           conn,
+				Writer:         writer,
+				Hello:          *accepted,
+				LastConnection: time.Now(),
+			})
+		case keepAlive:
+			if accepted != nil && touchConnection(id) {
+				continue
+			}
+			if refused || greeting != nil && accepted == nil {
+				continue
+			}
+			if accepted == nil {
+				refuse("no handshake: update the agent")
+				continue
+			}
+			// refreshClient dropped the connection for a late keep-alive,
+			// but it is alive and the agent is still downloading its ranges
+			m.resume(id, accepted.Session)
+			setConnection(id, &connectionData{
+				Conn:           conn,
+				Writer:         writer,
+				Hello:          *accepted,
+				LastConnection: time.Now(),
+			})
+			m.showClient(id, status, true)
+		case upload:
+			job := currentJob
+			if job == nil || job.ID != resp.Job {
+				cancelStale(resp.Job)
+				continue
+			}
+			if job.Finished {
+				continue
+			}
+
+			job.uploaded(resp.Upload)
+			job.Scheduler.Complete(resp.ID)
+			if next, ok := job.next(resp.ID); ok {
+				sendResponse(next)
+				continue
+			}
+			if job.finish() {
+				m.completeJob(job)
 			}
-			splitTransferData[resp.ID][resp.SplitTransfer.Index] = resp.SplitTransfer.Data
 		case progress:
 			objects := m.Log[resp.ID].Content.(*fyne.Container).Objects
 			switch resp.Progress.Command {
@@ -225,28 +268,312 @@ MAIN:
 				m.LogWindow.SetTitle(fmt.Sprintf("LogViewer - %s/s", humanize.Bytes(uint64(sum))))
 				card := objects[resp.Progress.ID].(*widget.Card)
 				card.SetSubTitle(resp.Progress.Text)
+				if resp.Progress.Percent < 0 {
+					switch card.Content.(type) {
+					case *widget.ProgressBar:
+						card.SetContent(widget.NewProgressBarInfinite())
+					}
+					continue
+				}
 				switch card.Content.(type) {
 				case *widget.ProgressBarInfinite:
 					card.SetContent(widget.NewProgressBar())
 				}
 				card.Content.(*widget.ProgressBar).SetValue(resp.Progress.Percent)
-			case splitTransfer:
-				m.Log[resp.ID].Content.(*fyne.Container).RemoveAll()
-				m.Log[resp.ID].Content.(*fyne.Container).Add(widget.NewCard("", resp.Progress.Text, widget.NewProgressBar()))
-				m.Log[resp.ID].Content.(*fyne.Container).Objects[0].(*widget.Card).SetSubTitle(resp.Progress.Text)
-			case compress:
-				m.LogWindow.SetTitle("LogViewer")
-				objects[resp.Progress.ID].(*widget.Card).SetSubTitle(resp.Progress.Text)
-				objects[resp.Progress.ID].(*widget.Card).SetContent(widget.NewProgressBarInfinite())
 			}
 		}
 	}
+	return refused
 }
 
+// dialAgent connects to an agent that listens at addr, and again whenever the
+// connection is lost, until the agent refuses the downloader or the server is
+// closed.
+func (m *mainAppData) dialAgent(addr string) {
+	first := true
+	for m.Connected {
+		conn, err := net.DialTimeout("tcp", addr, transport.DialTimeout)
+		if err != nil {
+			if first {
+				dialog.ShowError(fmt.Errorf("cannot connect to the agent at %s:\n%s", addr, err), m.Window)
+				return
+			}
+			log.Printf("cannot connect to the agent at %s: %s", addr, err)
+			time.Sleep(redialDelay)
+			continue
+		}
+		first = false
+
+		// The downloader is the TLS server whichever side dials.
+		if m.TLSConfig != nil {
+			conn = tls.Server(conn, m.TLSConfig)
+		}
+		if m.newConnection(conn) {
+			return
+		}
+		time.Sleep(redialDelay)
+	}
+}
+
+// reassign hands the unfinished ranges of the lost client id to the other
+// clients of job, falling back to the self client when none is left.
+func (m *mainAppData) reassign(job *jobData, id string) {
+	released := job.Scheduler.Release(id)
+	if len(released) == 0 {
+		return
+	}
+
+	var total int64
+	for _, r := range released {
+		total += r.Len()
+	}
+	m.logEvent(id, fmt.Sprintf("Connection lost, %s reassigned", humanize.Bytes(uint64(total))))
+
+	var clients []string
+	for _, client := range job.Agents {
+		if _, ok := findConnection(client); ok {
+			clients = append(clients, client)
+		}
+	}
+	if len(clients) == 0 {
+		if _, ok := findConnection("self_client"); !ok {
+			m.Processing.Hide()
+			dialog.ShowError(errors.New("every client is disconnected\nstart the download again to resume"), m.Window)
+			return
+		}
+		clients = []string{"self_client"}
+		job.Agents = append(job.Agents, "self_client")
+		m.addLog("self_client", job.Connection)
+	}
+
+	for _, client := range clients {
+		if !job.Scheduler.Idle(client) {
+			continue
+		}
+		if resp, ok := job.next(client); ok {
+			m.logEvent(client, "Took over the ranges of "+id)
+			sendResponse(resp)
+		}
+	}
+}
+
+// serveRelay joins room at the relay at addr as its downloader and serves the
+// agents that join it, joining again when the relay is lost.
+func (m *mainAppData) serveRelay(addr, room string) {
+	for m.Connected {
+		l, err := relay.Listen(addr, room)
+		if err != nil {
+			log.Printf("cannot join the room %s at the relay %s: %s", room, addr, err)
+			time.Sleep(redialDelay)
+			continue
+		}
+		log.Printf("Joined the room %s at the relay %s", room, addr)
+
+		if m.TLSConfig != nil {
+			l = tls.NewListener(l, m.TLSConfig)
+		}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			go m.newConnection(conn)
+		}
+		_ = l.Close()
+		time.Sleep(redialDelay)
+	}
+}
+
+// receiveData checks a data frame sent by the client id against its digest,
+// stores it into the current job and acknowledges it on w, so the client can
+// forget it. Every frame is acknowledged, even one of another job or one that
+// is corrupted or cannot be stored; the scheduler hands out again what is
+// missing from the files.
+func (m *mainAppData) receiveData(id string, w *frame.Writer, h frame.Header, payload []byte) {
+	defer func() {
+		_ = w.Write(frame.Header{Command: frame.Ack, Job: h.Job, File: h.File, Part: h.Part, Offset: h.Offset}, nil)
+	}()
+
+	job := currentJob
+	if job == nil || job.ID != h.Job || job.Finished {
+		return
+	}
+
+	data, err := frame.Open(h.Codec, payload)
+	if err != nil {
+		// The range stays missing, so the scheduler hands it out again once
+		// the client reports its part done.
+		m.logEvent(id, fmt.Sprintf("Part %d of file %d: %s at offset %d, downloading it again", h.Part, h.File, err, h.Offset))
+		return
+	}
+
+	if err := job.receive(int(h.File), h.Offset, data); err != nil {
+		log.Printf("%s: %s (%s)", id, err, h)
+		return
+	}
+	// The range an agent stole may be the last one missing while its owner
+	// is still downloading it.
+	if job.finish() {
+		m.completeJob(job)
+	}
+}
+
+// resume is called when the client id is accepted. A client that lost its
+// connection during the current job keeps its ranges if it comes back with
+// the same session; otherwise they are handed to the other clients now. That
+// includes a client still listed as connected, like an agent restarted before
+// its keep-alives were missed.
+func (m *mainAppData) resume(id, session string) {
+	lostMu.Lock()
+	client, ok := lost[id]
+	delete(lost, id)
+	lostMu.Unlock()
+	if conn, connected := findConnection(id); connected && !ok {
+		client, ok = lostClient{Session: conn.Hello.Session, Since: conn.LastConnection}, true
+	}
+
+	job := currentJob
+	if !ok || job == nil || job.Finished {
+		return
+	}
+	if client.Session == session {
+		m.logEvent(id, "Reconnected, resuming the upload")
+		return
+	}
+	go m.reassign(job, id)
+}
+
+// completeJob finalizes the files of job once every range is on disk, and
+// stops the clients still downloading ranges another client already sent.
+func (m *mainAppData) completeJob(job *jobData) {
+	cancelJob(job)
+	if err := job.commit(); err != nil {
+		m.Processing.Hide()
+		dialog.ShowError(errors.New("cannot save the file:\n"+err.Error()), m.Window)
+		return
+	}
+
+	switch job.Files[0].Type {
+	case generalFile:
+		// Looking for the checksum and hashing a large file take a while, so
+		// they do not hold up the connection that completed the job.
+		elapsed := time.Now().Sub(startTime)
+		m.Processing.Hide()
+		verifying := dialog.NewProgressInfinite("Verify", "Verifying the checksum...", m.Window)
+		verifying.Show()
+		go func() {
+			result, passed := job.verify("downloaded")
+			log.Print(result)
+			verifying.Hide()
+			m.showComplete(elapsed, result, passed)
+		}()
+		return
+	case youtubeVideo:
+		if len(job.Files) == 2 {
+			ffmpeg, ok := checkFFmpeg()
+			if !ok {
+				dialog.ShowError(errors.New("ffmpeg does not exist"), m.Window)
+				return
+			}
+
+			if err := cmd.PrepareBackgroundCommand(exec.Command(ffmpeg, "-y",
+				"-i", "downloaded/"+job.Files[0].Filename,
+				"-i", "downloaded/"+job.Files[1].Filename,
+				"-c:v", "copy",
+				"-c:a", "copy",
+				"-shortest",
+				"downloaded/youtube_with_audio.mp4",
+				"-loglevel", "warning",
+			)).Run(); err != nil {
+				dialog.ShowError(errors.New("cannot merge audio"), m.Window)
+				return
+			}
+
+			for _, file := range job.Files {
+				_ = os.Remove("downloaded/" + file.Filename)
+			}
+		}
+	}
+	m.showComplete(time.Now().Sub(startTime), "", true)
+}
+
+// showComplete marks the logs complete and shows the elapsed time and the
+// result of the checksum, as an error when it did not pass.
+func (m *mainAppData) showComplete(elapsed time.Duration, result string, passed bool) {
+	for _, item := range m.Log {
+		objects := item.Content.(*fyne.Container).Objects
+		if len(objects) == 0 {
+			continue
+		}
+		bar := widget.NewProgressBar()
+		bar.SetValue(1)
+		objects[0].(*widget.Card).SetSubTitle("Download complete")
+		objects[0].(*widget.Card).SetContent(bar)
+	}
+	m.Processing.Hide()
+	message := fmt.Sprintf("Download complete\nElapsed time: %s", durationFormat(elapsed.Seconds()))
+	if len(result) > 0 {
+		message += "\n" + result
+	}
+	if !passed {
+		dialog.ShowError(errors.New(message), m.Window)
+		return
+	}
+	dialog.ShowInformation("Done", message, m.Window)
+}
+
+// cancelJob tells the connected clients of job to stop downloading it.
+func cancelJob(job *jobData) {
+	for _, id := range job.Agents {
+		if _, ok := findConnection(id); ok {
+			sendResponse(networkResponse{ID: id, Job: job.ID, Command: cancelDownload})
+		}
+	}
+}
+
+// findConnection returns the connection of the client id.
+func findConnection(id string) (*connectionData, bool) {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+
+	conn, ok := connections[id]
+	return conn, ok
+}
+
+func setConnection(id string, conn *connectionData) {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+
+	connections[id] = conn
+}
+
+// touchConnection records a keep-alive of the client id, and reports whether
+// it is still connected.
+func touchConnection(id string) bool {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+
+	conn, ok := connections[id]
+	if ok {
+		conn.LastConnection = time.Now()
+	}
+	return ok
+}
+
+// sendResponse writes data to the client data.ID. It does nothing when the
+// client is not connected, since refreshClient may drop it at any time.
 func sendResponse(data networkResponse) {
+	conn, ok := findConnection(data.ID)
+	if !ok {
+		log.Printf("%s: not connected, %s not sent", data.ID, data.Command)
+		return
+	}
+	writeResponse(conn.Writer, data)
+}
+
+func writeResponse(w *frame.Writer, data networkResponse) {
 	jsonData, _ := json.Marshal(data)
-	n, err := connections[data.ID].Conn.Write(jsonData)
-	if err == nil {
-		log.Printf("write %d byte(s)", n)
+	if err := w.Write(frame.Header{Command: frame.Control}, jsonData); err == nil {
+		log.Printf("write %d byte(s)", frame.HeaderSize+len(jsonData))
 	}
 }
@@ -0,0 +1,22 @@
+// Package transport opens the connections between the downloader and its
+// agents.
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// DialTimeout bounds a single connection attempt, including the TLS
+// handshake.
+const DialTimeout = 5 * time.Second
+
+// Dial connects to addr, over TLS when config is not nil.
+func Dial(addr string, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	if config == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is where the downloader accepts agents over WebSocket.
+const WebSocketPath = "/agent"
+
+// DialWebSocket connects to the WebSocket URL rawURL (ws:// or wss://),
+// through the proxy in HTTPS_PROXY when it is set. The returned connection
+// carries the agent protocol in binary frames.
+func DialWebSocket(rawURL string) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ws":
+		if len(port) == 0 {
+			port = "80"
+		}
+	case "wss":
+		if len(port) == 0 {
+			port = "443"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	if len(u.Path) == 0 {
+		u.Path = WebSocketPath
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	// The tunnel is opened with CONNECT whatever the scheme, so HTTPS_PROXY
+	// applies to both.
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialProxy(proxy, addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, DialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialProxy opens a tunnel to addr through the HTTP proxy at proxy.
+func dialProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if len(proxy.Port()) == 0 {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s refused the tunnel: %s", proxy.Host, resp.Status)
+	}
+	if reader.Buffered() != 0 {
+		_ = conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was open")
+	}
+	return conn, nil
+}
+
+// ListenWebSocket accepts agents over WebSocket on addr. Each connection
+// accepted from the returned listener is an agent on WebSocketPath.
+func ListenWebSocket(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Server{Handler: wl.serve})
+	go func() {
+		_ = http.Serve(l, mux)
+	}()
+	return wl, nil
+}
+
+type wsListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// wsConn is an accepted WebSocket connection. The handler that accepted it
+// returns, and the server closes it, once closed is closed.
+type wsConn struct {
+	*websocket.Conn
+	remote    net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (l *wsListener) serve(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws, remote: l.Addr(), closed: make(chan struct{})}
+	if remote, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		conn.remote = remote
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		return
+	}
+	select {
+	case <-conn.closed:
+	case <-l.done:
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}